@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/samgabel/web-server/internal/auth"
 	"github.com/samgabel/web-server/internal/database"
@@ -39,24 +43,15 @@ func (cfg *apiConfig) handlerResetMetrics(w http.ResponseWriter, r *http.Request
 	cfg.fileserverHits = 0
 }
 
-func (cfg *apiConfig) handlerPostChirp(db *database.DB) http.HandlerFunc {
+func handlerPostChirp(db database.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		requestJWT, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
-		if !ok {
-			respondWithError(w, http.StatusBadRequest, "Malformed Authorization request header")
-			return
-		}
-		userID, err := auth.VerifySignedJWT(requestJWT, cfg.jwtSecret)
-		if err != nil {
-			respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Unauthorized attempt to login using JWT: %s", err))
-			return
-		}
+		userID := principal(r).UserID
 		type parameters struct {
 			Body string `json:"body"`
 		}
 		decoder := json.NewDecoder(r.Body)
 		params := parameters{}
-		err = decoder.Decode(&params)
+		err := decoder.Decode(&params)
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 			return
@@ -72,37 +67,55 @@ func (cfg *apiConfig) handlerPostChirp(db *database.DB) http.HandlerFunc {
 			return
 		}
 		respondWithJSON(w, http.StatusCreated, Chirp{
-			ID:       chirp.ID,
-			Body:     chirp.Body,
-			AuthorID: userID,
+			ID:        chirp.ID,
+			Body:      chirp.Body,
+			AuthorID:  userID,
+			CreatedAt: chirp.CreatedAt,
+			UpdatedAt: chirp.UpdatedAt,
 		})
 	}
 }
 
-func handlerGetChirps(db *database.DB) http.HandlerFunc {
+func handlerGetChirps(db database.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		chirps, err := db.GetChirps()
+		chirpQuery, err := processChirpQuery(r.URL.Query())
+		if err != nil {
+			respondWithQueryError(w, err)
+			return
+		}
+		page, err := db.ListChirps(chirpQuery)
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error getting Chirps from database: %s", err))
 			return
 		}
-		queryAuthorID := r.URL.Query().Get("author_id")
-		querySelection, err := processQueryAuthorID(chirps, queryAuthorID)
+		respondWithChirpPage(w, r, page)
+	}
+}
+
+func handlerSearchChirps(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chirpQuery, err := processSearchQuery(r.URL.Query())
 		if err != nil {
-			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Can't process author_id query: %s", err))
+			respondWithQueryError(w, err)
+			return
+		}
+		page, err := db.SearchChirps(database.SearchQuery{
+			ChirpQuery: chirpQuery,
+			Text:       r.URL.Query().Get("q"),
+		})
+		if errors.Is(err, database.ErrSearchQueryEmpty) {
+			respondWithQueryError(w, &queryParamError{Param: "q", Err: err})
 			return
 		}
-		querySortType := r.URL.Query().Get("sort")
-		querySelectionSorted, err := processQuerySort(querySelection, querySortType)
 		if err != nil {
-			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Can't process sort query: %s", err))
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error searching Chirps in database: %s", err))
 			return
 		}
-		respondWithJSON(w, http.StatusOK, querySelectionSorted)
+		respondWithChirpPage(w, r, page)
 	}
 }
 
-func handlerGetChirpByID(db *database.DB) http.HandlerFunc {
+func handlerGetChirpByID(db database.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		chirpIDString := r.PathValue("chirpID")
 		chirpID, err := strconv.Atoi(chirpIDString)
@@ -115,24 +128,53 @@ func handlerGetChirpByID(db *database.DB) http.HandlerFunc {
 			respondWithError(w, http.StatusNotFound, fmt.Sprintf("Chirp not found in database: %s", err))
 			return
 		}
+		if targetChirp.IsDeleted() {
+			respondWithError(w, http.StatusGone, database.ErrChirpDeleted.Error())
+			return
+		}
 		respondWithJSON(w, http.StatusOK, Chirp{
-			ID:   targetChirp.ID,
-			Body: targetChirp.Body,
+			ID:        targetChirp.ID,
+			Body:      targetChirp.Body,
+			AuthorID:  targetChirp.AuthorID,
+			CreatedAt: targetChirp.CreatedAt,
+			UpdatedAt: targetChirp.UpdatedAt,
 		})
 	}
 }
 
-func (cfg *apiConfig) handlerDeleteChirpByID(db *database.DB) http.HandlerFunc {
+func handlerDeleteChirpByID(db database.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		requestJWT, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
-		if !ok {
-			respondWithError(w, http.StatusBadRequest, "Malformed Authorization request header")
+		requestUserID := principal(r).UserID
+		chirpIDString := r.PathValue("chirpID")
+		chirpID, err := strconv.Atoi(chirpIDString)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid Chirp ID")
 			return
 		}
-		requestUserID, err := auth.VerifySignedJWT(requestJWT, cfg.jwtSecret)
+		targetChirp, err := db.GetChirp(chirpID)
 		if err != nil {
-			respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Unauthorized attempt to login using JWT: %s", err))
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("Chirp not found in database: %s", err))
+			return
+		}
+		if targetChirp.IsDeleted() {
+			respondWithError(w, http.StatusGone, database.ErrChirpDeleted.Error())
+			return
+		}
+		if requestUserID != targetChirp.AuthorID {
+			respondWithError(w, http.StatusForbidden, "The requester ID doesn't match the author ID of the chirp")
+			return
 		}
+		if err := db.DeleteChirp(chirpID, requestUserID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed deleting the Chirp from the database: %s", err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (cfg *apiConfig) handlerRestoreChirpByID(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestUserID := principal(r).UserID
 		chirpIDString := r.PathValue("chirpID")
 		chirpID, err := strconv.Atoi(chirpIDString)
 		if err != nil {
@@ -148,15 +190,31 @@ func (cfg *apiConfig) handlerDeleteChirpByID(db *database.DB) http.HandlerFunc {
 			respondWithError(w, http.StatusForbidden, "The requester ID doesn't match the author ID of the chirp")
 			return
 		}
-		if err := db.DeleteChirp(chirpID); err != nil {
-			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed deleting the Chirp from the database: %s", err))
+		if !targetChirp.IsDeleted() {
+			respondWithError(w, http.StatusConflict, database.ErrChirpNotDeleted.Error())
 			return
 		}
-		w.WriteHeader(http.StatusNoContent)
+		if time.Since(*targetChirp.DeletedAt) > cfg.chirpRestoreWindow {
+			respondWithError(w, http.StatusGone, fmt.Sprintf("Chirp can only be restored within %s of being deleted", cfg.chirpRestoreWindow))
+			return
+		}
+		restoredChirp, err := db.RestoreChirp(chirpID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed restoring the Chirp in the database: %s", err))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, Chirp{
+			ID:        restoredChirp.ID,
+			Body:      restoredChirp.Body,
+			AuthorID:  restoredChirp.AuthorID,
+			CreatedAt: restoredChirp.CreatedAt,
+			UpdatedAt: restoredChirp.UpdatedAt,
+		})
 	}
 }
 
-func handlerPostUser(db *database.DB) http.HandlerFunc {
+// handlerPostUser creates an account with an unverified email address and mails it a verification token.
+func (cfg *apiConfig) handlerPostUser(db database.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		type parameters struct {
 			Email    string `json:"email"`
@@ -169,25 +227,64 @@ func handlerPostUser(db *database.DB) http.HandlerFunc {
 			respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 			return
 		}
+		if err := validateEmail(params.Email); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !cfg.checkPassword(w, params.Password, params.Email) {
+			return
+		}
 		user, err := db.CreateUser(params.Email, params.Password)
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("User could not be created: %s", err))
 			return
 		}
+		if err := cfg.sendEmailVerification(db, user); err != nil {
+			log.Printf("Verification email to user %d failed, it can be resent: %s", user.ID, err)
+		}
 		respondWithJSON(w, http.StatusCreated, User{
 			ID:              user.ID,
 			Email:           user.Email,
 			ChirpyRedStatus: user.ChirpyRedStatus,
+			Role:            string(user.Role),
+			EmailVerified:   user.EmailVerified,
+			CreatedAt:       user.CreatedAt,
+			UpdatedAt:       user.UpdatedAt,
 		})
 	}
 }
 
-func (cfg *apiConfig) handlerLogin(db *database.DB) http.HandlerFunc {
+// issueAccessToken signs an access token for the user of session, with the scopes of their current role, and records
+// it, so revoking the session also revokes the token.
+func (cfg *apiConfig) issueAccessToken(db database.Store, session database.Session, durationSeconds *int) (string, error) {
+	user, err := db.GetUser(session.UserID)
+	if err != nil {
+		return "", err
+	}
+	signedJWT, claims, err := auth.NewSignedJWT(session.UserID, roleScopes[user.Role], cfg.jwtKeys, durationSeconds)
+	if err != nil {
+		return "", err
+	}
+	err = db.RecordAccessToken(database.AccessToken{
+		ID:        claims.ID,
+		UserID:    session.UserID,
+		SessionID: session.ID,
+		ExpiresAt: claims.ExpiresAt.Time,
+	})
+	if err != nil {
+		return "", err
+	}
+	return signedJWT, nil
+}
+
+// handlerLogin signs a user in with their password, or responds with an MFAChallenge if they enabled it.
+func (cfg *apiConfig) handlerLogin(db database.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		type parameters struct {
 			Email            string `json:"email"`
 			Password         string `json:"password"`
 			ExpiresInSeconds *int   `json:"expires_in_seconds"`
+			DeviceLabel      string `json:"device_label"`
 		}
 		decoder := json.NewDecoder(r.Body)
 		params := parameters{}
@@ -196,92 +293,247 @@ func (cfg *apiConfig) handlerLogin(db *database.DB) http.HandlerFunc {
 			respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 			return
 		}
-		user, err := db.AuthenticateUser(params.Email, params.Password)
+		limits, err := cfg.loginLimits(db, r, params.Email)
 		if err != nil {
-			respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("User could not be authenticated: %s", err))
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't look up the user in the database: %s", err))
 			return
 		}
-		refreshToken, err := auth.GenerateRefreshToken()
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Refresh Token could not be created: %s", err))
+		reservation, ok := reserveLoginAttempt(w, db, limits...)
+		if !ok {
 			return
 		}
-		err = db.WriteRefreshToken(user.ID, refreshToken)
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Could not update process refresh token: %s", err))
+		user, err := db.AuthenticateUser(params.Email, params.Password)
+		if errors.Is(err, database.ErrEmailNotExist) || errors.Is(err, database.ErrPasswordMismatch) {
+			respondWithError(w, http.StatusUnauthorized, errLoginFailed)
 			return
 		}
-		signedJWT, err := auth.NewSignedJWT(user.ID, cfg.jwtSecret, params.ExpiresInSeconds)
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("JWT could not be created: %s", err))
+			releaseLoginAttempt(db, reservation, limits...)
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("User could not be authenticated: %s", err))
 			return
 		}
-		respondWithJSON(w, http.StatusOK, AuthenticatedUser{
-			ID:              user.ID,
-			Email:           user.Email,
-			RefreshToken:    refreshToken,
-			Token:           signedJWT,
-			ChirpyRedStatus: user.ChirpyRedStatus,
-		})
+		mfa, err := db.GetMFA(user.ID)
+		if err != nil && !errors.Is(err, database.ErrMFANotEnrolled) {
+			releaseLoginAttempt(db, reservation, limits...)
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't look up two-factor authentication: %s", err))
+			return
+		}
+		ip := cfg.ipLimit(r)
+		if err == nil && mfa.Enabled {
+			// The account's failure stays counted until handlerLoginMFA gets a right code.
+			releaseLoginAttempt(db, reservation, ip)
+			cfg.respondWithMFAChallenge(w, db, user)
+			return
+		}
+		if err := loginSucceeded(db, reservation, cfg.accountLimit(user.ID), ip); err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't clear failed logins: %s", err))
+			return
+		}
+		cfg.signIn(w, r, db, user, params.DeviceLabel, params.ExpiresInSeconds)
 	}
 }
 
-func (cfg *apiConfig) handlerUpdateUser(db *database.DB) http.HandlerFunc {
+// signIn starts a session for an authenticated user and responds with its refresh and access tokens.
+func (cfg *apiConfig) signIn(w http.ResponseWriter, r *http.Request, db database.Store, user database.User, deviceLabel string, expiresInSeconds *int) {
+	if user.Suspended {
+		respondWithError(w, http.StatusForbidden, "Account is suspended")
+		return
+	}
+	refreshToken, err := auth.GenerateRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Refresh Token could not be created: %s", err))
+		return
+	}
+	session, err := db.CreateSession(user.ID, refreshToken, database.SessionDevice{
+		Label:     deviceLabel,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Could not update process refresh token: %s", err))
+		return
+	}
+	signedJWT, err := cfg.issueAccessToken(db, session, expiresInSeconds)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("JWT could not be created: %s", err))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, AuthenticatedUser{
+		ID:              user.ID,
+		Email:           user.Email,
+		RefreshToken:    refreshToken,
+		Token:           signedJWT,
+		ChirpyRedStatus: user.ChirpyRedStatus,
+		Role:            string(user.Role),
+		EmailVerified:   user.EmailVerified,
+		CreatedAt:       user.CreatedAt,
+		UpdatedAt:       user.UpdatedAt,
+	})
+}
+
+// handlerPatchUser changes the fields that are sent given the current password, a new email once it's confirmed.
+func (cfg *apiConfig) handlerPatchUser(db database.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		requestJWT, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
-		if !ok {
-			respondWithError(w, http.StatusBadRequest, "Malformed Authorization request header")
-			return
-		}
 		type parameters struct {
-			Email    string `json:"email"`
-			Password string `json:"password"`
+			Email           *string `json:"email"`
+			Password        *string `json:"password"`
+			CurrentPassword string  `json:"current_password"`
 		}
 		params := parameters{}
 		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
 			respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 			return
 		}
-		userID, err := auth.VerifySignedJWT(requestJWT, cfg.jwtSecret)
+		if params.Email == nil && params.Password == nil {
+			respondWithError(w, http.StatusBadRequest, "Nothing to update, send an email or a password")
+			return
+		}
+		user, err := db.GetUser(principal(r).UserID)
 		if err != nil {
-			respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Unauthorized attempt to login using JWT: %s", err))
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't look up the user in the database: %s", err))
+			return
+		}
+		if params.Email != nil && *params.Email == user.Email {
+			params.Email = nil
+		}
+		if params.Email != nil {
+			if err := validateEmail(*params.Email); err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if params.Password != nil && !cfg.checkPassword(w, *params.Password, user.Email) {
+			return
+		}
+		account, ip := cfg.accountLimit(user.ID), cfg.ipLimit(r)
+		reservation, ok := reserveLoginAttempt(w, db, account, ip)
+		if !ok {
+			return
+		}
+		_, err = db.AuthenticateUser(user.Email, params.CurrentPassword)
+		if errors.Is(err, database.ErrPasswordMismatch) {
+			respondWithError(w, http.StatusForbidden, "Current password is incorrect")
 			return
 		}
-		user, err := db.UpdateUser(userID, params.Email, params.Password)
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to update user info: %s", err))
+			releaseLoginAttempt(db, reservation, account, ip)
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("User could not be authenticated: %s", err))
 			return
 		}
+		if err := loginSucceeded(db, reservation, account, ip); err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't clear failed logins: %s", err))
+			return
+		}
+		if params.Email != nil {
+			_, err := db.GetUserByEmail(*params.Email)
+			if err == nil {
+				respondWithError(w, http.StatusConflict, database.ErrEmailRegistered.Error())
+				return
+			}
+			if !errors.Is(err, database.ErrEmailNotExist) {
+				respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't look up the email in the database: %s", err))
+				return
+			}
+		}
+		pendingEmail := ""
+		if params.Email != nil {
+			if err := cfg.sendEmailChange(db, user, *params.Email); err != nil {
+				respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't send the email change confirmation: %s", err))
+				return
+			}
+			pendingEmail = *params.Email
+		}
+		if params.Password != nil {
+			user, err = db.UpdateUser(user.ID, database.UserUpdate{
+				Password:       params.Password,
+				CurrentTokenID: principal(r).ID,
+			})
+			if err != nil && pendingEmail != "" {
+				respondWithError(w, http.StatusInternalServerError, fmt.Sprintf(
+					"The email change confirmation was sent, but the password couldn't be updated: %s", err,
+				))
+				return
+			}
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to update user info: %s", err))
+				return
+			}
+		}
 		respondWithJSON(w, http.StatusOK, User{
 			ID:              user.ID,
 			Email:           user.Email,
 			ChirpyRedStatus: user.ChirpyRedStatus,
+			Role:            string(user.Role),
+			EmailVerified:   user.EmailVerified,
+			CreatedAt:       user.CreatedAt,
+			UpdatedAt:       user.UpdatedAt,
+			PendingEmail:    pendingEmail,
 		})
 	}
 }
 
-func (cfg *apiConfig) handlerRefresh(db *database.DB) http.HandlerFunc {
+// handlerPutUser serves the deprecated PUT /api/users with the rules of handlerPatchUser.
+func (cfg *apiConfig) handlerPutUser(db database.Store) http.HandlerFunc {
+	patchUser := cfg.handlerPatchUser(db)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", `</api/users>; rel="successor-version"`)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't read the request body")
+			return
+		}
+		params := struct {
+			CurrentPassword *string `json:"current_password"`
+		}{}
+		if err := json.Unmarshal(body, &params); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+			return
+		}
+		if params.CurrentPassword == nil {
+			respondWithError(w, http.StatusBadRequest,
+				"PUT /api/users is deprecated and now takes current_password, use PATCH /api/users to change the email or password")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		patchUser(w, r)
+	}
+}
+
+func (cfg *apiConfig) handlerRefresh(db database.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		requestRefreshToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
 		if !ok {
 			respondWithError(w, http.StatusBadRequest, "Malformed Authorization request header")
 			return
 		}
-		newJWT, err := db.RefreshJWT(requestRefreshToken, cfg.jwtSecret)
+		newRefreshToken, err := auth.GenerateRefreshToken()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Refresh Token could not be created: %s", err))
+			return
+		}
+		session, err := db.RotateSession(requestRefreshToken, newRefreshToken)
 		if err != nil {
 			respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Unable to hand out new JWT: %s", err))
 			return
 		}
+		newJWT, err := cfg.issueAccessToken(db, session, nil)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("JWT could not be created: %s", err))
+			return
+		}
 		type responseShape struct {
-			Token string `json:"token"`
+			Token        string `json:"token"`
+			RefreshToken string `json:"refresh_token"`
 		}
 		respondWithJSON(w, http.StatusOK, responseShape{
-			Token: newJWT,
+			Token:        newJWT,
+			RefreshToken: newRefreshToken,
 		})
 	}
 }
 
-func (cfg *apiConfig) handlerRevokeRefresh(db *database.DB) http.HandlerFunc {
+func (cfg *apiConfig) handlerRevokeRefresh(db database.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		requestRefreshToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
 		if !ok {
@@ -297,7 +549,49 @@ func (cfg *apiConfig) handlerRevokeRefresh(db *database.DB) http.HandlerFunc {
 	}
 }
 
-func (cfg *apiConfig) handlerChirpyRedConfirmation(db *database.DB) http.HandlerFunc {
+func handlerGetSessions(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessions, err := db.ListSessions(principal(r).UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error retrieving sessions from database: %s", err))
+			return
+		}
+		response := []Session{}
+		for _, session := range sessions {
+			response = append(response, Session{
+				ID:          session.ID,
+				DeviceLabel: session.Label,
+				UserAgent:   session.UserAgent,
+				IP:          session.IP,
+				CreatedAt:   session.CreatedAt,
+				LastUsedAt:  session.LastUsedAt,
+				ExpiresAt:   session.ExpiresAt,
+			})
+		}
+		respondWithJSON(w, http.StatusOK, response)
+	}
+}
+
+func handlerDeleteSession(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID, err := strconv.Atoi(r.PathValue("sessionID"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid session ID")
+			return
+		}
+		if err := db.DeleteSession(principal(r).UserID, sessionID); err != nil {
+			if errors.Is(err, database.ErrSessionNotExist) {
+				respondWithError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed revoking the session in the database: %s", err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (cfg *apiConfig) handlerChirpyRedConfirmation(db database.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		requestKey, ok := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey ")
 		if !ok {
@@ -334,3 +628,9 @@ func (cfg *apiConfig) handlerChirpyRedConfirmation(db *database.DB) http.Handler
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
+
+// handlerJWKS publishes the public keys access tokens are signed with.
+func (cfg *apiConfig) handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, cfg.jwtKeys.JWKS())
+}
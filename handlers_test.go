@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/samgabel/web-server/internal/auth"
+	"github.com/samgabel/web-server/internal/database"
+	"github.com/samgabel/web-server/internal/mailer"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testStores opens an empty database with each of the drivers.
+func testStores(t *testing.T) map[string]database.Store {
+	t.Helper()
+	params := auth.DefaultPasswordHashParams
+	params.Algorithm = auth.AlgorithmBcrypt
+	params.BcryptCost = bcrypt.MinCost
+	passwords, err := auth.NewPasswordHasher(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]database.Store{}
+	for driver, file := range map[string]string{database.DriverJSON: "database.json", database.DriverSQLite: "database.db"} {
+		db, err := database.Open(database.Config{
+			Driver:           driver,
+			Path:             filepath.Join(t.TempDir(), file),
+			SnapshotInterval: time.Hour,
+			Passwords:        passwords,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		stores[driver] = db
+	}
+	return stores
+}
+
+// testConfig is an apiConfig with the lockout policies the tests count against.
+func testConfig(t *testing.T) *apiConfig {
+	t.Helper()
+	keys, err := auth.NewHMACKeyset("test secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &apiConfig{
+		jwtKeys:        keys,
+		accountLockout: database.LockoutPolicy{MaxFailures: 5, Lockout: time.Minute, MaxLockout: time.Hour},
+		ipLockout:      database.LockoutPolicy{MaxFailures: 100, Lockout: time.Minute, MaxLockout: time.Hour},
+	}
+}
+
+// postJSON sends body to handler and returns the response.
+func postJSON(t *testing.T, handler http.Handler, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	return sendJSON(t, handler, http.MethodPost, "", body)
+}
+
+// sendJSON sends body to handler with an access token, if one is given, and returns the response.
+func sendJSON(t *testing.T, handler http.Handler, method, token string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(method, "/", bytes.NewReader(data))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// failingMailer refuses to send anything.
+type failingMailer struct{}
+
+func (failingMailer) Send(mailer.Message) error {
+	return errors.New("mail server is down")
+}
+
+// signInTest logs in with email and password and returns the access token.
+func signInTest(t *testing.T, cfg *apiConfig, db database.Store, email, password string) AuthenticatedUser {
+	t.Helper()
+	w := postJSON(t, cfg.handlerLogin(db), map[string]string{"email": email, "password": password})
+	if w.Code != http.StatusOK {
+		t.Fatalf("login got status %d: %s", w.Code, w.Body)
+	}
+	var user AuthenticatedUser
+	if err := json.NewDecoder(w.Body).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// TestPatchUserMailFailure changes the email and the password at once while the confirmation can't be mailed.
+// Neither may be applied.
+func TestPatchUserMailFailure(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.mailer = failingMailer{}
+			const email, password = "patch@example.com", "correct horse battery staple"
+			if _, err := db.CreateUser(email, password); err != nil {
+				t.Fatal(err)
+			}
+			token := signInTest(t, cfg, db, email, password).Token
+			w := sendJSON(t, cfg.middlewareRequireAuth(db, cfg.handlerPatchUser(db)), http.MethodPatch, token, map[string]string{
+				"email":            "new@example.com",
+				"password":         "a brand new password",
+				"current_password": password,
+			})
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusInternalServerError)
+			}
+			if _, err := db.AuthenticateUser(email, password); err != nil {
+				t.Errorf("old password no longer works: %v", err)
+			}
+		})
+	}
+}
+
+// TestPutUserDeprecated checks PUT tells clients that don't send current_password about the change, and works
+// like PATCH for those that do.
+func TestPutUserDeprecated(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig(t)
+			const email, password, newPassword = "put@example.com", "correct horse battery staple", "a brand new password"
+			if _, err := db.CreateUser(email, password); err != nil {
+				t.Fatal(err)
+			}
+			token := signInTest(t, cfg, db, email, password).Token
+			putUser := cfg.middlewareRequireAuth(db, cfg.handlerPutUser(db))
+
+			w := sendJSON(t, putUser, http.MethodPut, token, map[string]string{"email": email, "password": newPassword})
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("without current_password got status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			if w.Header().Get("Deprecation") == "" {
+				t.Error("response has no Deprecation header")
+			}
+
+			w = sendJSON(t, putUser, http.MethodPut, token, map[string]string{"password": newPassword, "current_password": password})
+			if w.Code != http.StatusOK {
+				t.Fatalf("with current_password got status %d: %s", w.Code, w.Body)
+			}
+			if _, err := db.AuthenticateUser(email, newPassword); err != nil {
+				t.Errorf("new password doesn't work: %v", err)
+			}
+		})
+	}
+}
+
+// TestAccessTokenDeniedOnLogout revokes the refresh token of a session. The access token issued with it has to
+// stop working right away instead of when it expires.
+func TestAccessTokenDeniedOnLogout(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig(t)
+			const email, password = "logout@example.com", "correct horse battery staple"
+			if _, err := db.CreateUser(email, password); err != nil {
+				t.Fatal(err)
+			}
+			user := signInTest(t, cfg, db, email, password)
+			other := signInTest(t, cfg, db, email, password)
+			getSessions := cfg.middlewareRequireAuth(db, handlerGetSessions(db))
+			if w := sendJSON(t, getSessions, http.MethodGet, user.Token, nil); w.Code != http.StatusOK {
+				t.Fatalf("before logout got status %d: %s", w.Code, w.Body)
+			}
+
+			if w := sendJSON(t, cfg.handlerRevokeRefresh(db), http.MethodPost, user.RefreshToken, nil); w.Code != http.StatusNoContent {
+				t.Fatalf("logout got status %d: %s", w.Code, w.Body)
+			}
+			if w := sendJSON(t, getSessions, http.MethodGet, user.Token, nil); w.Code != http.StatusUnauthorized {
+				t.Errorf("after logout got status %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+			if w := sendJSON(t, getSessions, http.MethodGet, other.Token, nil); w.Code != http.StatusOK {
+				t.Errorf("other session after logout got status %d, want %d", w.Code, http.StatusOK)
+			}
+		})
+	}
+}
+
+// TestAccessTokenDeniedOnPasswordChange changes the password. Every access token the user was issued has to stop
+// working, including the one the change was made with.
+func TestAccessTokenDeniedOnPasswordChange(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig(t)
+			const email, password = "change@example.com", "correct horse battery staple"
+			if _, err := db.CreateUser(email, password); err != nil {
+				t.Fatal(err)
+			}
+			tokens := []string{
+				signInTest(t, cfg, db, email, password).Token,
+				signInTest(t, cfg, db, email, password).Token,
+			}
+			w := sendJSON(t, cfg.middlewareRequireAuth(db, cfg.handlerPatchUser(db)), http.MethodPatch, tokens[0], map[string]string{
+				"password":         "a brand new password",
+				"current_password": password,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("password change got status %d: %s", w.Code, w.Body)
+			}
+			getSessions := cfg.middlewareRequireAuth(db, handlerGetSessions(db))
+			for i, token := range tokens {
+				if w := sendJSON(t, getSessions, http.MethodGet, token, nil); w.Code != http.StatusUnauthorized {
+					t.Errorf("token %d after password change got status %d, want %d", i+1, w.Code, http.StatusUnauthorized)
+				}
+			}
+		})
+	}
+}
@@ -1,15 +1,164 @@
 package auth
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
 
-func HashPassword(password string) ([]byte, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrPasswordEmpty is returned by PasswordHasher.Hash, an empty password would match anything typed into a blank
+	// form.
+	ErrPasswordEmpty    = errors.New("Password can't be empty")
+	ErrPasswordMismatch = errors.New("Password doesn't match the hash")
+	ErrHashFormat       = errors.New("Password hash has an unknown format")
+)
+
+// PasswordAlgorithm is what new password hashes are computed with, existing hashes of any algorithm still check.
+type PasswordAlgorithm string
+
+const (
+	AlgorithmArgon2id PasswordAlgorithm = "argon2id"
+	AlgorithmBcrypt   PasswordAlgorithm = "bcrypt"
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// Argon2Params are the cost parameters of argon2id, Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// PasswordHashParams choose the algorithm and cost of new password hashes.
+type PasswordHashParams struct {
+	Algorithm  PasswordAlgorithm
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// DefaultPasswordHashParams follow the OWASP recommendation for argon2id, and bcrypt's own default cost.
+var DefaultPasswordHashParams = PasswordHashParams{
+	Algorithm:  AlgorithmArgon2id,
+	BcryptCost: bcrypt.DefaultCost,
+	Argon2:     Argon2Params{Memory: 19 * 1024, Iterations: 2, Parallelism: 1},
+}
+
+// PasswordHasher hashes passwords with the configured parameters into self-describing bcrypt or PHC strings.
+type PasswordHasher struct {
+	params PasswordHashParams
+	// dummyHash is what CheckDummyPassword compares against, computed up front.
+	dummyHash []byte
+}
+
+// NewPasswordHasher checks the parameters of both algorithms, not just the selected one, so a mistake doesn't go
+// unnoticed until the algorithm is switched.
+func NewPasswordHasher(params PasswordHashParams) (*PasswordHasher, error) {
+	if params.Algorithm != AlgorithmArgon2id && params.Algorithm != AlgorithmBcrypt {
+		return nil, fmt.Errorf("Unknown password hash algorithm %q, need %q or %q", params.Algorithm, AlgorithmArgon2id, AlgorithmBcrypt)
+	}
+	if params.BcryptCost < bcrypt.MinCost || params.BcryptCost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost has to be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if params.Argon2.Iterations < 1 || params.Argon2.Parallelism < 1 {
+		return nil, errors.New("argon2id needs at least one iteration and one thread")
+	}
+	if params.Argon2.Memory < 8*uint32(params.Argon2.Parallelism) {
+		return nil, errors.New("argon2id needs at least 8 KiB of memory per thread")
+	}
+	h := &PasswordHasher{params: params}
+	dummyHash, err := h.Hash("chirpy-dummy-password")
 	if err != nil {
+		return nil, err
+	}
+	h.dummyHash = dummyHash
+	return h, nil
+}
+
+// Hash hashes password with the configured algorithm and a random salt.
+func (h *PasswordHasher) Hash(password string) ([]byte, error) {
+	if password == "" {
+		return []byte{}, ErrPasswordEmpty
+	}
+	if h.params.Algorithm == AlgorithmBcrypt {
+		return bcrypt.GenerateFromPassword([]byte(password), h.params.BcryptCost)
+	}
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
 		return []byte{}, err
 	}
-	return hash, nil
+	p := h.params.Argon2
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, argon2KeyLength)
+	return []byte(fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	)), nil
+}
+
+// NeedsRehash reports whether hash was made with another algorithm or other parameters than the configured ones, so
+// it should be replaced the next time the password is known.
+func (h *PasswordHasher) NeedsRehash(hash []byte) bool {
+	if bytes.HasPrefix(hash, []byte("$argon2id$")) {
+		p, _, _, err := decodeArgon2Hash(hash)
+		return err != nil || h.params.Algorithm != AlgorithmArgon2id || p != h.params.Argon2
+	}
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || h.params.Algorithm != AlgorithmBcrypt || cost != h.params.BcryptCost
 }
 
+// CheckDummyPassword takes as long as CheckPasswordHash, for emails without an account to check against.
+func (h *PasswordHasher) CheckDummyPassword(password string) {
+	CheckPasswordHash(h.dummyHash, password) //nolint:errcheck
+}
+
+// CheckPasswordHash checks password against a hash in any of the supported formats.
 func CheckPasswordHash(hash []byte, password string) error {
-	return bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if !bytes.HasPrefix(hash, []byte("$argon2id$")) {
+		return bcrypt.CompareHashAndPassword(hash, []byte(password))
+	}
+	p, salt, key, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return err
+	}
+	candidate := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(candidate, key) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+// decodeArgon2Hash parses the PHC string format written by PasswordHasher.Hash.
+func decodeArgon2Hash(hash []byte) (Argon2Params, []byte, []byte, error) {
+	parts := bytes.Split(hash, []byte("$"))
+	if len(parts) != 6 {
+		return Argon2Params{}, nil, nil, ErrHashFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(string(parts[2]), "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, ErrHashFormat
+	}
+	p := Argon2Params{}
+	if _, err := fmt.Sscanf(string(parts[3]), "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return Argon2Params{}, nil, nil, ErrHashFormat
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(string(parts[4]))
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrHashFormat
+	}
+	key, err := base64.RawStdEncoding.DecodeString(string(parts[5]))
+	if err != nil || len(key) == 0 {
+		return Argon2Params{}, nil, nil, ErrHashFormat
+	}
+	return p, salt, key, nil
 }
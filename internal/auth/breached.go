@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"os"
+	"strings"
+)
+
+// breachedFalsePositiveRate is how often the bloom filter rejects a password that isn't on the list.
+const breachedFalsePositiveRate = 0.001
+
+// BreachedPasswords is a bloom filter of passwords known from data breaches.
+type BreachedPasswords struct {
+	bits   []uint64
+	hashes int
+	count  int
+}
+
+// LoadBreachedPasswords reads a list of one password, or hex SHA-1 with an optional ":<count>", per line.
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	count := 0
+	err := scanBreachedPasswords(path, func([sha1.Size]byte) { count++ })
+	if err != nil {
+		return nil, err
+	}
+	bitCount := uint64(math.Ceil(-float64(max(count, 1)) * math.Log(breachedFalsePositiveRate) / (math.Ln2 * math.Ln2)))
+	breached := &BreachedPasswords{
+		bits:   make([]uint64, (bitCount+63)/64),
+		hashes: max(1, int(math.Round(float64(bitCount)/float64(max(count, 1))*math.Ln2))),
+		count:  count,
+	}
+	err = scanBreachedPasswords(path, func(digest [sha1.Size]byte) {
+		for _, bit := range breached.positions(digest) {
+			breached.bits[bit/64] |= 1 << (bit % 64)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return breached, nil
+}
+
+// scanBreachedPasswords calls add with the SHA-1 of every password in the list at path.
+func scanBreachedPasswords(path string, add func([sha1.Size]byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if prefix, _, _ := strings.Cut(line, ":"); len(prefix) == hex.EncodedLen(sha1.Size) {
+			var digest [sha1.Size]byte
+			if _, err := hex.Decode(digest[:], []byte(prefix)); err == nil {
+				add(digest)
+				continue
+			}
+		}
+		add(sha1.Sum([]byte(line)))
+	}
+	return scanner.Err()
+}
+
+// positions derives the bits of a password from its SHA-1 with double hashing, the digest is uniform enough already.
+func (b *BreachedPasswords) positions(digest [sha1.Size]byte) []uint64 {
+	size := uint64(len(b.bits)) * 64
+	h1 := binary.BigEndian.Uint64(digest[0:8])
+	h2 := binary.BigEndian.Uint64(digest[8:16]) | 1
+	positions := make([]uint64, b.hashes)
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % size
+	}
+	return positions
+}
+
+// Contains reports whether password is probably on the list.
+func (b *BreachedPasswords) Contains(password string) bool {
+	for _, bit := range b.positions(sha1.Sum([]byte(password))) {
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Len is the number of passwords the list was loaded with.
+func (b *BreachedPasswords) Len() int {
+	return b.count
+}
@@ -2,63 +2,132 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	jwt "github.com/golang-jwt/jwt/v5"
 )
 
-func NewSignedJWT(userID int, jwtSecret string, durationSeconds *int) (string, error) {
+const (
+	issuer   = "Chirpy"
+	audience = "chirpy-api"
+	// clockSkewLeeway is how far the issuer's and a verifier's clocks may drift apart for nbf and exp.
+	clockSkewLeeway = 30 * time.Second
+)
+
+// Scopes an access token can carry.
+const (
+	ScopeChirpsWrite = "chirps:write"
+	ScopeAdmin       = "admin"
+)
+
+// Claims are the claims of a Chirpy access token, Scope holds the granted scopes separated by spaces.
+type Claims struct {
+	jwt.RegisteredClaims
+	Scope string `json:"scope,omitempty"`
+	// UserID is the subject parsed by VerifySignedJWT.
+	UserID int `json:"-"`
+}
+
+// HasScope reports whether the token was granted scope.
+func (c *Claims) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(c.Scope), scope)
+}
+
+// Denylist reports access tokens revoked before their expiry.
+type Denylist interface {
+	IsAccessTokenDenied(jti string) (bool, error)
+}
+
+// NewSignedJWT issues an access token and returns it with its claims, so the caller can record its jti.
+func NewSignedJWT(userID int, scopes []string, keys *Keyset, durationSeconds *int) (string, *Claims, error) {
 	var expiry int
 	if durationSeconds == nil || *durationSeconds > 3600 {
 		expiry = 3600
 	} else {
 		expiry = *durationSeconds
 	}
-	newToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "Chirpy",
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(expiry) * time.Second)),
-		Subject:   strconv.Itoa(userID),
-	})
-	signingKey := []byte(jwtSecret)
-	return newToken.SignedString(signingKey)
+	tokenID, err := randomHex(16)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	claims := &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   strconv.Itoa(userID),
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(expiry) * time.Second)),
+			ID:        tokenID,
+		},
+		Scope:  strings.Join(scopes, " "),
+		UserID: userID,
+	}
+	signedJWT, err := keys.sign(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return signedJWT, claims, nil
 }
 
-func VerifySignedJWT(requestJWT string, jwtSecret string) (int, error) {
-	requestToken, err := jwt.ParseWithClaims(
-		requestJWT,
-		&jwt.RegisteredClaims{},
-		func(token *jwt.Token) (interface{}, error) { return []byte(jwtSecret), nil },
+// VerifySignedJWT returns the claims of a valid access token whose jti isn't in denylist.
+func VerifySignedJWT(requestJWT string, keys *Keyset, denylist Denylist) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(requestJWT, claims, keys.keyFor,
+		jwt.WithIssuer(issuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(clockSkewLeeway),
 	)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	issuer, err := requestToken.Claims.GetIssuer()
-	if err != nil {
-		return 0, err
-	}
-	if issuer != "Chirpy" {
-		return 0, errors.New("Invalid issuer")
+	if claims.ID == "" {
+		return nil, errors.New("Token has no jti")
 	}
-	stringID, err := requestToken.Claims.GetSubject()
+	denied, err := denylist.IsAccessTokenDenied(claims.ID)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	if denied {
+		return nil, errors.New("Token has been revoked")
 	}
-	id, err := strconv.Atoi(stringID)
+	claims.UserID, err = strconv.Atoi(claims.Subject)
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("Invalid subject: %w", err)
 	}
-	return id, nil
+	return claims, nil
 }
 
 func GenerateRefreshToken() (string, error) {
-	randBytes := make([]byte, 32)
+	return randomHex(32)
+}
+
+// GeneratePasswordResetToken returns a one-time password reset token, stored by its HashRefreshToken digest.
+func GeneratePasswordResetToken() (string, error) {
+	return randomHex(32)
+}
+
+// randomHex returns n random bytes encoded as hex.
+func randomHex(n int) (string, error) {
+	randBytes := make([]byte, n)
 	_, err := rand.Read(randBytes)
 	if err != nil {
 		return "", err
 	}
 	return hex.EncodeToString(randBytes), nil
 }
+
+// HashRefreshToken returns the hex SHA-256 digest a refresh token is stored as.
+func HashRefreshToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
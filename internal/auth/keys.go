@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// minRSAKeyBits is the smallest RSA modulus accepted for signing or verifying tokens.
+const minRSAKeyBits = 2048
+
+// Keyset holds the key access tokens are signed with and every key they're still verified against.
+type Keyset struct {
+	signing *signingKey
+	// keys holds the public half of every asymmetric key by its ID, including retired ones.
+	keys map[string]verificationKey
+	// secret is the HS256 JWT_SECRET, for tokens without a kid and for signing when there's no other key.
+	secret []byte
+}
+
+type signingKey struct {
+	id         string
+	method     jwt.SigningMethod
+	privateKey crypto.Signer
+}
+
+type verificationKey struct {
+	method    jwt.SigningMethod
+	publicKey crypto.PublicKey
+}
+
+// NewHMACKeyset signs and verifies tokens with HS256 and a shared secret.
+func NewHMACKeyset(secret string) (*Keyset, error) {
+	if secret == "" {
+		return nil, errors.New("JWT secret is empty")
+	}
+	return &Keyset{keys: map[string]verificationKey{}, secret: []byte(secret)}, nil
+}
+
+// LoadKeyset reads the RSA or Ed25519 <kid>.pem keys in dir and signs with signingKeyID, or the only private key.
+func LoadKeyset(dir, signingKeyID, secret string) (*Keyset, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	keyset := &Keyset{keys: map[string]verificationKey{}, secret: []byte(secret)}
+	signers := map[string]crypto.Signer{}
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := readPEMKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("Key %s: %w", id, err)
+		}
+		var publicKey crypto.PublicKey = key
+		if signer, ok := key.(crypto.Signer); ok {
+			signers[id] = signer
+			publicKey = signer.Public()
+		}
+		method, err := methodForKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("Key %s: %w", id, err)
+		}
+		keyset.keys[id] = verificationKey{method: method, publicKey: publicKey}
+	}
+	if signingKeyID == "" && len(signers) == 1 {
+		for id := range signers {
+			signingKeyID = id
+		}
+	}
+	if signingKeyID == "" {
+		return nil, fmt.Errorf("Found %d private keys in %s, name the one to sign with", len(signers), dir)
+	}
+	signer, ok := signers[signingKeyID]
+	if !ok {
+		return nil, fmt.Errorf("No private key %s found in %s", signingKeyID, dir)
+	}
+	keyset.signing = &signingKey{id: signingKeyID, method: keyset.keys[signingKeyID].method, privateKey: signer}
+	return keyset, nil
+}
+
+func readPEMKey(path string) (any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM block found")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block %q, expected PRIVATE KEY or PUBLIC KEY", block.Type)
+	}
+}
+
+func methodForKey(publicKey crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key is %d bits, at least %d are required", key.N.BitLen(), minRSAKeyBits)
+		}
+		return jwt.SigningMethodRS256, nil
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("Unsupported key type %T, expected RSA or Ed25519", publicKey)
+	}
+}
+
+// sign signs claims with the current key, adding its kid to the header.
+func (k *Keyset) sign(claims jwt.Claims) (string, error) {
+	if k.signing == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.secret)
+	}
+	token := jwt.NewWithClaims(k.signing.method, claims)
+	token.Header["kid"] = k.signing.id
+	return token.SignedString(k.signing.privateKey)
+}
+
+// keyFor is a jwt.Keyfunc picking a token's key by its kid, only for the algorithm of that key.
+func (k *Keyset) keyFor(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		if len(k.secret) == 0 || token.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("Token has no kid")
+		}
+		return k.secret, nil
+	}
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("Unknown kid %q", kid)
+	}
+	if token.Method != key.method {
+		return nil, fmt.Errorf("Key %s doesn't sign with %s", kid, token.Method.Alg())
+	}
+	return key.publicKey, nil
+}
+
+// JWKS is a JSON Web Key Set as served from /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is the public half of an RSA or Ed25519 key.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// N and E are set for RSA keys.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Curve and X are set for Ed25519 keys.
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS returns the public keys tokens may be verified with, ordered by kid.
+func (k *Keyset) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		key := k.keys[id]
+		jwk := JWK{KeyID: id, Use: "sig", Algorithm: key.method.Alg()}
+		switch publicKey := key.publicKey.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CharacterClass is a kind of character a PasswordPolicy can require at least one of.
+type CharacterClass string
+
+const (
+	ClassLower  CharacterClass = "lower"
+	ClassUpper  CharacterClass = "upper"
+	ClassDigit  CharacterClass = "digit"
+	ClassSymbol CharacterClass = "symbol"
+)
+
+// ParseCharacterClasses parses a comma separated list such as "lower,digit".
+func ParseCharacterClasses(list string) ([]CharacterClass, error) {
+	var classes []CharacterClass
+	for _, name := range strings.Split(list, ",") {
+		class := CharacterClass(strings.TrimSpace(name))
+		switch class {
+		case "":
+			continue
+		case ClassLower, ClassUpper, ClassDigit, ClassSymbol:
+			classes = append(classes, class)
+		default:
+			return nil, fmt.Errorf("Unknown character class %q", class)
+		}
+	}
+	return classes, nil
+}
+
+// description names the class after "Password must contain ".
+func (c CharacterClass) description() string {
+	switch c {
+	case ClassLower:
+		return "a lowercase letter"
+	case ClassUpper:
+		return "an uppercase letter"
+	case ClassDigit:
+		return "a digit"
+	}
+	return "a symbol"
+}
+
+func (c CharacterClass) matches(r rune) bool {
+	switch c {
+	case ClassLower:
+		return unicode.IsLower(r)
+	case ClassUpper:
+		return unicode.IsUpper(r)
+	case ClassDigit:
+		return unicode.IsDigit(r)
+	case ClassSymbol:
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+	}
+	return false
+}
+
+// PasswordViolation is a rule of a PasswordPolicy that a password broke.
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicy decides which passwords users can choose.
+type PasswordPolicy struct {
+	// MinLength is counted in characters, MaxLength in bytes since that's what the password hash is limited by.
+	MinLength       int
+	MaxLength       int
+	RequiredClasses []CharacterClass
+	// Breached rejects passwords known from data breaches, it's not checked when nil.
+	Breached *BreachedPasswords
+}
+
+// Check returns every rule password breaks for the account with email, or nothing if it's acceptable.
+func (p PasswordPolicy) Check(password, email string) []PasswordViolation {
+	var violations []PasswordViolation
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, PasswordViolation{
+			Rule:    "min_length",
+			Message: fmt.Sprintf("Password must be at least %d characters long", p.MinLength),
+		})
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		violations = append(violations, PasswordViolation{
+			Rule:    "max_length",
+			Message: fmt.Sprintf("Password can't be longer than %d bytes", p.MaxLength),
+		})
+	}
+	for _, class := range p.RequiredClasses {
+		if !strings.ContainsFunc(password, class.matches) {
+			violations = append(violations, PasswordViolation{
+				Rule:    "require_" + string(class),
+				Message: "Password must contain " + class.description(),
+			})
+		}
+	}
+	if email != "" && strings.EqualFold(password, email) {
+		violations = append(violations, PasswordViolation{
+			Rule:    "not_email",
+			Message: "Password can't be the same as the email address",
+		})
+	}
+	if p.Breached != nil && p.Breached.Contains(password) {
+		violations = append(violations, PasswordViolation{
+			Rule:    "breached",
+			Message: "Password has appeared in a data breach, please choose another one",
+		})
+	}
+	return violations
+}
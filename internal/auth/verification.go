@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// The audiences of single-purpose tokens keep them and access tokens from being accepted in place of each other.
+const (
+	verificationAudience = "chirpy-email-verification"
+	emailChangeAudience  = "chirpy-email-change"
+	mfaChallengeAudience = "chirpy-mfa-challenge"
+)
+
+// VerificationClaims are the claims of an email verification or email change token.
+type VerificationClaims struct {
+	jwt.RegisteredClaims
+	// Email is the address the token was sent to.
+	Email string `json:"email"`
+	// UserID is the subject parsed by VerifyEmailVerificationToken and VerifyEmailChangeToken.
+	UserID int `json:"-"`
+}
+
+// NewEmailVerificationToken issues a token proving whoever holds it reads the inbox of email.
+func NewEmailVerificationToken(userID int, email string, keys *Keyset, lifetime time.Duration) (string, *VerificationClaims, error) {
+	return newAddressToken(userID, email, verificationAudience, keys, lifetime)
+}
+
+// VerifyEmailVerificationToken returns the claims of a valid email verification token.
+func VerifyEmailVerificationToken(token string, keys *Keyset) (*VerificationClaims, error) {
+	return verifyAddressToken(token, verificationAudience, keys)
+}
+
+// NewEmailChangeToken issues a token that moves a user to the address email once it's sent back from that inbox.
+func NewEmailChangeToken(userID int, email string, keys *Keyset, lifetime time.Duration) (string, *VerificationClaims, error) {
+	return newAddressToken(userID, email, emailChangeAudience, keys, lifetime)
+}
+
+// VerifyEmailChangeToken returns the claims of a valid email change token.
+func VerifyEmailChangeToken(token string, keys *Keyset) (*VerificationClaims, error) {
+	return verifyAddressToken(token, emailChangeAudience, keys)
+}
+
+// newAddressToken issues a token for aud that's mailed to email.
+func newAddressToken(userID int, email, aud string, keys *Keyset, lifetime time.Duration) (string, *VerificationClaims, error) {
+	registered, err := purposeClaims(userID, aud, lifetime)
+	if err != nil {
+		return "", nil, err
+	}
+	claims := &VerificationClaims{RegisteredClaims: registered, Email: email, UserID: userID}
+	signedJWT, err := keys.sign(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return signedJWT, claims, nil
+}
+
+// verifyAddressToken parses a token issued by newAddressToken for aud.
+func verifyAddressToken(token, aud string, keys *Keyset) (*VerificationClaims, error) {
+	claims := &VerificationClaims{}
+	userID, err := parsePurposeToken(token, claims, aud, keys)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID == "" {
+		return nil, errors.New("Token has no jti")
+	}
+	claims.UserID = userID
+	return claims, nil
+}
+
+// MFAChallengeClaims are the claims of the token a password login hands out when the user still has to enter a
+// second factor.
+type MFAChallengeClaims struct {
+	jwt.RegisteredClaims
+	// UserID is the subject parsed by VerifyMFAChallengeToken.
+	UserID int `json:"-"`
+}
+
+// NewMFAChallengeToken issues a token proving that the user got their password right.
+func NewMFAChallengeToken(userID int, keys *Keyset, lifetime time.Duration) (string, *MFAChallengeClaims, error) {
+	registered, err := purposeClaims(userID, mfaChallengeAudience, lifetime)
+	if err != nil {
+		return "", nil, err
+	}
+	claims := &MFAChallengeClaims{RegisteredClaims: registered, UserID: userID}
+	signedJWT, err := keys.sign(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return signedJWT, claims, nil
+}
+
+// VerifyMFAChallengeToken checks the signature, issuer, audience and expiry of an MFA challenge token and returns
+// its claims.
+func VerifyMFAChallengeToken(token string, keys *Keyset) (*MFAChallengeClaims, error) {
+	claims := &MFAChallengeClaims{}
+	userID, err := parsePurposeToken(token, claims, mfaChallengeAudience, keys)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID == "" {
+		return nil, errors.New("Token has no jti")
+	}
+	claims.UserID = userID
+	return claims, nil
+}
+
+// purposeClaims are the registered claims of a single-purpose token for a user, with a fresh jti.
+func purposeClaims(userID int, aud string, lifetime time.Duration) (jwt.RegisteredClaims, error) {
+	tokenID, err := randomHex(16)
+	if err != nil {
+		return jwt.RegisteredClaims{}, err
+	}
+	now := time.Now()
+	return jwt.RegisteredClaims{
+		Issuer:    issuer,
+		Subject:   strconv.Itoa(userID),
+		Audience:  jwt.ClaimStrings{aud},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(lifetime)),
+		ID:        tokenID,
+	}, nil
+}
+
+// parsePurposeToken parses token into claims, checking it was issued for aud, and returns the user ID in its subject.
+func parsePurposeToken(token string, claims jwt.Claims, aud string, keys *Keyset) (int, error) {
+	_, err := jwt.ParseWithClaims(token, claims, keys.keyFor,
+		jwt.WithIssuer(issuer),
+		jwt.WithAudience(aud),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(clockSkewLeeway),
+	)
+	if err != nil {
+		return 0, err
+	}
+	subject, err := claims.GetSubject()
+	if err != nil {
+		return 0, err
+	}
+	userID, err := strconv.Atoi(subject)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid subject: %w", err)
+	}
+	return userID, nil
+}
@@ -0,0 +1,43 @@
+package database
+
+import "time"
+
+// RecordAccessToken remembers an issued access token and drops expired tokens and denylist entries.
+func (db *DB) RecordAccessToken(token AccessToken) error {
+	return db.Update(func(dbStruct *DBStructure) error {
+		now := time.Now()
+		for jti, accessToken := range dbStruct.AccessTokens {
+			if !accessToken.ExpiresAt.After(now) {
+				remove(dbStruct, &dbStruct.AccessTokens, jti)
+			}
+		}
+		for jti, expiresAt := range dbStruct.DeniedTokens {
+			if !expiresAt.After(now) {
+				remove(dbStruct, &dbStruct.DeniedTokens, jti)
+			}
+		}
+		put(dbStruct, &dbStruct.AccessTokens, token.ID, token)
+		return nil
+	})
+}
+
+// IsAccessTokenDenied reports whether the access token with this jti has been revoked.
+func (db *DB) IsAccessTokenDenied(jti string) (bool, error) {
+	denied := false
+	err := db.View(func(dbStruct DBStructure) error {
+		_, denied = dbStruct.DeniedTokens[jti]
+		return nil
+	})
+	return denied, err
+}
+
+// denyAccessTokens moves the recorded access tokens picked by which onto the denylist.
+func (dbStruct *DBStructure) denyAccessTokens(which func(token AccessToken) bool) {
+	for jti, token := range dbStruct.AccessTokens {
+		if !which(token) {
+			continue
+		}
+		put(dbStruct, &dbStruct.DeniedTokens, jti, token.ExpiresAt)
+		remove(dbStruct, &dbStruct.AccessTokens, jti)
+	}
+}
@@ -3,63 +3,225 @@ package database
 import (
 	"errors"
 	"sort"
+	"time"
+)
+
+var (
+	ErrChirpNotExist   = errors.New("Chirp ID doesn't exist")
+	ErrChirpDeleted    = errors.New("Chirp has been deleted")
+	ErrChirpNotDeleted = errors.New("Chirp has not been deleted")
 )
 
 func (db *DB) CreateChirp(authorID int, body string) (Chirp, error) {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
-	newID := len(dbStruct.Chirps) + 1
-	newChirp := Chirp{
-		ID:       newID,
-		Body:     body,
-		AuthorID: authorID,
-	}
-	if dbStruct.Chirps == nil {
-		dbStruct.Chirps = make(map[int]Chirp)
-	}
-	dbStruct.Chirps[newID] = newChirp
-	err = db.writeDB(dbStruct)
+	var newChirp Chirp
+	err := db.update(func(dbStruct *DBStructure) error {
+		newID := dbStruct.nextID(chirpsTable)
+		now := time.Now().UTC()
+		newChirp = Chirp{
+			ID:        newID,
+			Body:      body,
+			AuthorID:  authorID,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		put(dbStruct, &dbStruct.Chirps, newID, newChirp)
+		return nil
+	}, func() {
+		db.index.add(newChirp)
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
 	return newChirp, nil
 }
 
+// GetChirps returns every chirp that hasn't been deleted, ordered by ID.
 func (db *DB) GetChirps() ([]Chirp, error) {
-	dbStruct, err := db.loadDB()
+	var chirps []Chirp
+	err := db.View(func(dbStruct DBStructure) error {
+		chirps = make([]Chirp, 0, len(dbStruct.Chirps))
+		for _, chirp := range dbStruct.Chirps {
+			if chirp.IsDeleted() {
+				continue
+			}
+			chirps = append(chirps, chirp)
+		}
+		return nil
+	})
 	if err != nil {
 		return []Chirp{}, err
 	}
-	chirps := make([]Chirp, 0, len(dbStruct.Chirps))
-	for _, chirp := range dbStruct.Chirps {
-		chirps = append(chirps, chirp)
-	}
 	sort.Slice(chirps, func(i, j int) bool { return chirps[i].ID < chirps[j].ID })
 	return chirps, nil
 }
 
+// ListChirps returns a page of chirps. IDs come from a sequence, so when ordering by ID it walks them in order
+// starting from the cursor and stops once the page is full instead of sorting the whole table. Other orderings
+// sort the chirps that match the filters.
+func (db *DB) ListChirps(q ChirpQuery) (ChirpPage, error) {
+	var chirps []Chirp
+	err := db.View(func(dbStruct DBStructure) error {
+		if q.sortBy() != SortByID {
+			for _, chirp := range dbStruct.Chirps {
+				if q.matches(chirp) && q.afterCursor(chirp) {
+					chirps = append(chirps, chirp)
+				}
+			}
+			return nil
+		}
+		last := dbStruct.Sequences[chirpsTable]
+		id, step := 1, 1
+		if q.Descending {
+			id, step = last, -1
+		}
+		if q.After != nil {
+			id = q.After.ID + step
+		}
+		for ; id >= 1 && id <= last; id += step {
+			chirp, ok := dbStruct.Chirps[id]
+			if !ok || !q.matches(chirp) {
+				continue
+			}
+			chirps = append(chirps, chirp)
+			if q.Limit > 0 && len(chirps) > q.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	if q.sortBy() != SortByID {
+		sort.Slice(chirps, func(i, j int) bool { return q.less(chirps[i], chirps[j]) })
+		if q.Limit > 0 && len(chirps) > q.Limit+1 {
+			chirps = chirps[:q.Limit+1]
+		}
+	}
+	return newChirpPage(q, chirps), nil
+}
+
+// SearchChirps returns a page of the chirps matching q.Text from the search index, best match first.
+func (db *DB) SearchChirps(q SearchQuery) (ChirpPage, error) {
+	clauses, err := parseSearch(q.Text)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	var chirps []Chirp
+	var scores map[int]float64
+	err = db.View(func(dbStruct DBStructure) error {
+		scores = db.index.search(clauses)
+		chirps = make([]Chirp, 0, len(scores))
+		for id := range scores {
+			if chirp, ok := dbStruct.Chirps[id]; ok && q.matches(chirp) {
+				chirps = append(chirps, chirp)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	sort.Slice(chirps, func(i, j int) bool {
+		if scores[chirps[i].ID] != scores[chirps[j].ID] {
+			return scores[chirps[i].ID] > scores[chirps[j].ID]
+		}
+		return chirps[i].ID > chirps[j].ID
+	})
+	chirps = chirps[min(q.offset(), len(chirps)):]
+	if q.Limit > 0 && len(chirps) > q.Limit+1 {
+		chirps = chirps[:q.Limit+1]
+	}
+	return newSearchPage(q, chirps), nil
+}
+
+// GetChirp returns the chirp with the given ID, including tombstones so callers can tell a deleted chirp apart
+// from one that never existed.
 func (db *DB) GetChirp(id int) (Chirp, error) {
-	dbStruct, err := db.loadDB()
+	var targetChirp Chirp
+	err := db.View(func(dbStruct DBStructure) error {
+		chirp, ok := dbStruct.Chirps[id]
+		if !ok {
+			return ErrChirpNotExist
+		}
+		targetChirp = chirp
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
-	targetChirp, ok := dbStruct.Chirps[id]
-	if !ok {
-		return Chirp{}, errors.New("Chirp ID doesn't exist")
-	}
 	return targetChirp, nil
 }
 
-func (db *DB) DeleteChirp(id int) error {
-	dbStruct, err := db.loadDB()
+// DeleteChirp soft deletes the chirp, leaving a tombstone that can be restored until PurgeChirps removes it.
+func (db *DB) DeleteChirp(id, deletedBy int) error {
+	var deletedChirp Chirp
+	return db.update(func(dbStruct *DBStructure) error {
+		chirp, ok := dbStruct.Chirps[id]
+		if !ok {
+			return ErrChirpNotExist
+		}
+		if chirp.IsDeleted() {
+			return ErrChirpDeleted
+		}
+		now := time.Now().UTC()
+		chirp.DeletedAt = &now
+		chirp.DeletedBy = deletedBy
+		chirp.UpdatedAt = now
+		put(dbStruct, &dbStruct.Chirps, id, chirp)
+		deletedChirp = chirp
+		return nil
+	}, func() {
+		db.index.remove(deletedChirp)
+	})
+}
+
+func (db *DB) RestoreChirp(id int) (Chirp, error) {
+	var restoredChirp Chirp
+	err := db.update(func(dbStruct *DBStructure) error {
+		chirp, ok := dbStruct.Chirps[id]
+		if !ok {
+			return ErrChirpNotExist
+		}
+		if !chirp.IsDeleted() {
+			return ErrChirpNotDeleted
+		}
+		chirp.DeletedAt = nil
+		chirp.DeletedBy = 0
+		chirp.UpdatedAt = time.Now().UTC()
+		put(dbStruct, &dbStruct.Chirps, id, chirp)
+		restoredChirp = chirp
+		return nil
+	}, func() {
+		db.index.add(restoredChirp)
+	})
 	if err != nil {
-		return err
+		return Chirp{}, err
 	}
-	if _, ok := dbStruct.Chirps[id]; !ok {
-		return errors.New("Chirp ID doesn't exist")
+	return restoredChirp, nil
+}
+
+// PurgeChirps hard deletes every tombstone deleted before the given time and returns how many were removed.
+// Tombstones are already out of the search index.
+func (db *DB) PurgeChirps(deletedBefore time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(dbStruct *DBStructure) error {
+		for id, chirp := range dbStruct.Chirps {
+			if chirp.IsDeleted() && chirp.DeletedAt.Before(deletedBefore) {
+				remove(dbStruct, &dbStruct.Chirps, id)
+				purged++
+			}
+		}
+		if purged == 0 {
+			return errNothingToWrite
+		}
+		return nil
+	})
+	if errors.Is(err, errNothingToWrite) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
 	}
-	dbStruct.Chirps[id] = Chirp{}
-	return db.writeDB(dbStruct)
+	return purged, nil
 }
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// BenchmarkGetChirps compares serving the chirp listing from the resident database with parsing the JSON file on
+// every read, which is what each request did before the database was kept in memory.
+func BenchmarkGetChirps(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		path := filepath.Join(b.TempDir(), "database.json")
+		seedChirps(b, path, n)
+
+		b.Run(fmt.Sprintf("cached/%d", n), func(b *testing.B) {
+			db := openTestDB(b, path, time.Hour)
+			b.ResetTimer()
+			for range b.N {
+				if _, err := db.GetChirps(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("parse-per-read/%d", n), func(b *testing.B) {
+			for range b.N {
+				if _, err := parseChirps(path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCreateChirp compares adding a chirp to a database of n chirps when only the change is logged with
+// rewriting the whole JSON file on every Update, which is what a snapshot interval of 0 does.
+func BenchmarkCreateChirp(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		path := filepath.Join(b.TempDir(), "database.json")
+		seedChirps(b, path, n)
+
+		for _, mode := range []struct {
+			name     string
+			interval time.Duration
+		}{{"log-only", time.Hour}, {"snapshot-per-write", 0}} {
+			b.Run(fmt.Sprintf("%s/%d", mode.name, n), func(b *testing.B) {
+				db := openTestDB(b, copyDB(b, path), mode.interval)
+				b.ResetTimer()
+				for range b.N {
+					if _, err := db.CreateChirp(1, "a new chirp"); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// seedChirps writes a database with n chirps to path.
+func seedChirps(b *testing.B, path string, n int) {
+	b.Helper()
+	db := openTestDB(b, path, time.Hour)
+	err := db.Update(func(dbStruct *DBStructure) error {
+		dbStruct.Chirps = make(map[int]Chirp, n)
+		now := time.Now().UTC()
+		for range n {
+			id := dbStruct.nextID(chirpsTable)
+			put(dbStruct, &dbStruct.Chirps, id, Chirp{
+				ID:        id,
+				Body:      fmt.Sprintf("chirp number %d", id),
+				AuthorID:  id%10 + 1,
+				CreatedAt: now,
+				UpdatedAt: now,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// parseChirps is GetChirps reading the JSON file from scratch.
+func parseChirps(path string) ([]Chirp, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dbStruct := DBStructure{}
+	if err := json.Unmarshal(data, &dbStruct); err != nil {
+		return nil, err
+	}
+	chirps := make([]Chirp, 0, len(dbStruct.Chirps))
+	for _, chirp := range dbStruct.Chirps {
+		if !chirp.IsDeleted() {
+			chirps = append(chirps, chirp)
+		}
+	}
+	sort.Slice(chirps, func(i, j int) bool { return chirps[i].ID < chirps[j].ID })
+	return chirps, nil
+}
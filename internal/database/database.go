@@ -3,53 +3,193 @@ package database
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"os"
+	"time"
 )
 
+// walMinCompactSize is how large the write-ahead log can always grow before an Update compacts it into the JSON
+// file itself. Past that it's compacted once it outgrows the file, regardless of the snapshot interval.
+const walMinCompactSize = 1 << 20
+
+// errNothingToWrite lets an Update callback bail out without writing when it finds there's nothing to change.
+var errNothingToWrite = errors.New("Nothing to write")
+
+// View hands the resident database to fn while holding the read lock. fn must not modify dbStruct.
+func (db *DB) View(fn func(dbStruct DBStructure) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return fn(db.data)
+}
+
+// Update holds the write lock while fn modifies the resident database, so concurrent updates can't read the same
+// version and overwrite each other. The records fn puts and removes are logged to the write-ahead log, and taken
+// back if fn returns an error or the log can't be written. Once the change is in the log it's committed, so a
+// failed snapshot afterwards is only logged.
+func (db *DB) Update(fn func(dbStruct *DBStructure) error) error {
+	return db.update(fn, nil)
+}
+
+// update is Update with a committed callback that runs under the same write lock once the new version is in
+// place, for keeping in-memory structures derived from the database in step with it.
+func (db *DB) update(fn func(dbStruct *DBStructure) error, committed func()) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	changes := []change{}
+	db.data.changes = &changes
+	defer func() { db.data.changes = nil }()
+	if err := fn(&db.data); err != nil {
+		rollback(changes)
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	data, err := db.data.encodeChanges(changes)
+	if err == nil {
+		err = db.appendWAL(data)
+	}
+	if err != nil {
+		rollback(changes)
+		return err
+	}
+	db.dirty = true
+	db.walSize += int64(walHeaderSize + len(data))
+	if committed != nil {
+		committed()
+	}
+	if db.snapshotInterval <= 0 || db.walSize >= max(db.fileSize, walMinCompactSize) {
+		if err := db.snapshot(); err != nil {
+			log.Printf("Database snapshot failed, changes remain in the write-ahead log: %s", err)
+		}
+	}
+	return nil
+}
+
 func (db *DB) WipeDB() error {
+	db.mu.Lock()
 	err := os.Remove(db.path)
+	if err == nil {
+		err = db.truncateWAL()
+	}
+	db.mu.Unlock()
 	if err != nil {
 		return err
 	}
 	return db.ensureDB()
 }
 
+// Close stops the background snapshots and flushes any pending changes to the JSON file. Closing again only
+// flushes changes made since, if any.
+func (db *DB) Close() error {
+	db.stopOnce.Do(func() { close(db.stop) })
+	<-db.stopped
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.dirty {
+		return nil
+	}
+	return db.snapshot()
+}
+
+// snapshotLoop periodically writes the resident database to the JSON file until Close is called.
+func (db *DB) snapshotLoop() {
+	defer close(db.stopped)
+	if db.snapshotInterval <= 0 {
+		<-db.stop
+		return
+	}
+	ticker := time.NewTicker(db.snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+			db.mu.Lock()
+			if db.dirty {
+				if err := db.snapshot(); err != nil {
+					log.Printf("Database snapshot failed, changes remain in the write-ahead log: %s", err)
+				}
+			}
+			db.mu.Unlock()
+		}
+	}
+}
+
+// snapshot must be called with db.mu held for writing. It atomically replaces the JSON file with the resident
+// database and then clears the write-ahead log, whose records are all contained in the snapshot.
+func (db *DB) snapshot() error {
+	data, err := json.Marshal(db.data)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(db.path, data); err != nil {
+		return err
+	}
+	if err := db.truncateWAL(); err != nil {
+		return err
+	}
+	db.dirty = false
+	db.walSize = 0
+	db.fileSize = int64(len(data))
+	return nil
+}
+
+// ensureDB creates the database file if it's missing, finishes any write left in the write-ahead log and loads
+// the result into memory.
 func (db *DB) ensureDB() error {
-	db.mu.RLock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	_, err := os.ReadFile(db.path)
-	db.mu.RUnlock()
 	if errors.Is(err, os.ErrNotExist) {
-		err := os.WriteFile(db.path, []byte{}, 0644)
+		err := writeFileAtomic(db.path, []byte{})
 		if err != nil {
 			return err
 		}
 	}
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	replayed, err := db.replayWAL(&dbStruct)
+	if err != nil {
+		return err
+	}
+	db.data = dbStruct
+	db.dirty = false
+	db.walSize = 0
+	migrated, err := db.data.migrate()
+	if err != nil {
+		return err
+	}
+	db.index = newSearchIndex()
+	for _, chirp := range db.data.Chirps {
+		if !chirp.IsDeleted() {
+			db.index.add(chirp)
+		}
+	}
+	if replayed || migrated {
+		return db.snapshot()
+	}
 	return nil
 }
 
+// loadDB parses the JSON file. An empty file is a fresh database, anything else that isn't valid JSON is reported
+// as ErrCorrupt.
 func (db *DB) loadDB() (DBStructure, error) {
-	db.mu.RLock()
 	data, err := os.ReadFile(db.path)
-	db.mu.RUnlock()
 	if err != nil {
 		return DBStructure{}, err
 	}
+	db.fileSize = int64(len(data))
 	dbStruct := DBStructure{}
-	// nolint:errcheck
-	json.Unmarshal(data, &dbStruct)
-	return dbStruct, nil
-}
-
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	data, err := json.Marshal(dbStructure)
-	if err != nil {
-		return err
+	if len(data) == 0 {
+		return dbStruct, nil
 	}
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	err = os.WriteFile(db.path, data, 0644)
-	if err != nil {
-		return err
+	if err := json.Unmarshal(data, &dbStruct); err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %s: %s", ErrCorrupt, db.path, err)
 	}
-	return nil
+	return dbStruct, nil
 }
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samgabel/web-server/internal/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testPasswordHasher hashes passwords with the cheapest bcrypt cost.
+func testPasswordHasher(t testing.TB) *auth.PasswordHasher {
+	t.Helper()
+	params := auth.DefaultPasswordHashParams
+	params.Algorithm = auth.AlgorithmBcrypt
+	params.BcryptCost = bcrypt.MinCost
+	passwords, err := auth.NewPasswordHasher(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return passwords
+}
+
+// openTestDB opens the JSON database at path.
+func openTestDB(t testing.TB, path string, snapshotInterval time.Duration) *DB {
+	t.Helper()
+	db, err := NewDB(path, snapshotInterval, testPasswordHasher(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// openTestStore opens the database at path with driver.
+func openTestStore(t testing.TB, driver, path string) Store {
+	t.Helper()
+	if driver == DriverJSON {
+		return openTestDB(t, path, time.Hour)
+	}
+	db, err := Open(Config{Driver: driver, Path: path, Passwords: testPasswordHasher(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// TestConcurrentUpdates creates users and chirps from many goroutines at once. Every one of them has to end up
+// in the database with an ID of its own, so no write read a version another one was about to replace, and they
+// all have to be there again after reopening it.
+func TestConcurrentUpdates(t *testing.T) {
+	for _, driver := range []string{DriverJSON, DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			testConcurrentUpdates(t, driver)
+		})
+	}
+}
+
+func testConcurrentUpdates(t *testing.T, driver string) {
+	const n = 50
+	path := filepath.Join(t.TempDir(), "database")
+	db := openTestStore(t, driver, path)
+
+	var wg sync.WaitGroup
+	userIDs := make([]int, n)
+	chirpIDs := make([]int, n)
+	errs := make(chan error, 2*n)
+	for i := range n {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			user, err := db.CreateUser(fmt.Sprintf("user%d@example.com", i), "password")
+			if err != nil {
+				errs <- err
+				return
+			}
+			userIDs[i] = user.ID
+		}()
+		go func() {
+			defer wg.Done()
+			chirp, err := db.CreateChirp(1, fmt.Sprintf("chirp %d", i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			chirpIDs[i] = chirp.ID
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for name, ids := range map[string][]int{"user": userIDs, "chirp": chirpIDs} {
+		seen := make(map[int]bool, n)
+		for _, id := range ids {
+			if seen[id] {
+				t.Errorf("%s ID %d was handed out twice", name, id)
+			}
+			seen[id] = true
+		}
+	}
+	assertCreated(t, db, userIDs, chirpIDs)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertCreated(t, openTestStore(t, driver, path), userIDs, chirpIDs)
+}
+
+func assertCreated(t *testing.T, db Store, userIDs, chirpIDs []int) {
+	t.Helper()
+	for _, id := range userIDs {
+		if _, err := db.GetUser(id); err != nil {
+			t.Errorf("user %d: %s", id, err)
+		}
+	}
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != len(chirpIDs) {
+		t.Errorf("got %d chirps, want %d", len(chirps), len(chirpIDs))
+	}
+}
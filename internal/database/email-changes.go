@@ -0,0 +1,69 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrEmailChangeInvalid = errors.New("Email change token is invalid, expired or already used")
+
+// RecordEmailChange remembers a confirmation sent to a user's new address, replacing their earlier change.
+func (db *DB) RecordEmailChange(change EmailChange) error {
+	return db.Update(func(dbStruct *DBStructure) error {
+		now := time.Now()
+		for id, pending := range dbStruct.EmailChanges {
+			if pending.UserID == change.UserID || !pending.ExpiresAt.After(now) {
+				remove(dbStruct, &dbStruct.EmailChanges, id)
+			}
+		}
+		put(dbStruct, &dbStruct.EmailChanges, change.ID, change)
+		return nil
+	})
+}
+
+// ConfirmEmailChange uses up the confirmation with this jti and moves the user to the new, verified address.
+func (db *DB) ConfirmEmailChange(changeID string) (User, error) {
+	var changedUser User
+	var confirmErr error
+	err := db.Update(func(dbStruct *DBStructure) error {
+		change, ok := dbStruct.EmailChanges[changeID]
+		if !ok {
+			return ErrEmailChangeInvalid
+		}
+		remove(dbStruct, &dbStruct.EmailChanges, changeID)
+		user, ok := dbStruct.Users[change.UserID]
+		if !ok || !change.ExpiresAt.After(time.Now()) || user.Email != change.OldEmail {
+			confirmErr = ErrEmailChangeInvalid
+			return nil
+		}
+		for _, other := range dbStruct.Users {
+			if other.Email == change.NewEmail {
+				confirmErr = ErrEmailRegistered
+				return nil
+			}
+		}
+		for id, verification := range dbStruct.EmailVerifications {
+			if verification.UserID == user.ID {
+				remove(dbStruct, &dbStruct.EmailVerifications, id)
+			}
+		}
+		for tokenHash, reset := range dbStruct.PasswordResets {
+			if reset.UserID == user.ID {
+				remove(dbStruct, &dbStruct.PasswordResets, tokenHash)
+			}
+		}
+		user.Email = change.NewEmail
+		user.EmailVerified = true
+		user.UpdatedAt = time.Now().UTC()
+		put(dbStruct, &dbStruct.Users, user.ID, user)
+		changedUser = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	if confirmErr != nil {
+		return User{}, confirmErr
+	}
+	return changedUser, nil
+}
@@ -0,0 +1,152 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// LockoutPolicy decides when repeated failed logins lock a key out, and for how long.
+type LockoutPolicy struct {
+	// MaxFailures is how many failures in a row are let through before the key gets locked.
+	MaxFailures int
+	// Lockout is how long the first lockout lasts, doubling with every further failure up to MaxLockout.
+	Lockout    time.Duration
+	MaxLockout time.Duration
+}
+
+// lockoutFor is how long a key with this many failures in a row stays locked.
+func (p LockoutPolicy) lockoutFor(failures int) time.Duration {
+	if failures < p.MaxFailures {
+		return 0
+	}
+	lockout := p.Lockout
+	for i := p.MaxFailures; i < failures && lockout < p.MaxLockout; i++ {
+		lockout *= 2
+	}
+	return min(lockout, p.MaxLockout)
+}
+
+// record adds a failure at now to attempt, forgetting the earlier ones if they're too long ago.
+func (p LockoutPolicy) record(attempt LoginAttempt, now time.Time) LoginAttempt {
+	if now.Sub(attempt.LastFailureAt) > p.MaxLockout {
+		attempt.Failures = 0
+	}
+	attempt.Failures++
+	attempt.LastFailureAt = now
+	attempt.ExpiresAt = now.Add(p.MaxLockout)
+	if lockout := p.lockoutFor(attempt.Failures); lockout > 0 {
+		attempt.LockedUntil = now.Add(lockout)
+	}
+	return attempt
+}
+
+// LoginLimit is a key attempts are counted against, with the policy that locks it out.
+type LoginLimit struct {
+	Key    string
+	Policy LockoutPolicy
+}
+
+// LoginReservation is the outcome of ReserveLoginAttempt.
+type LoginReservation struct {
+	// LockedUntil is when the lockout that turned the attempt away ends, zero if the attempt was let through.
+	LockedUntil time.Time
+	// ReservedAt is when the attempt was counted, which ReleaseLoginAttempt needs to take it back.
+	ReservedAt time.Time
+}
+
+// Locked reports whether the attempt was turned away.
+func (r LoginReservation) Locked() bool {
+	return !r.LockedUntil.IsZero()
+}
+
+// ReserveLoginAttempt counts an attempt as failed against every limit unless any of them is locked out.
+func (db *DB) ReserveLoginAttempt(limits ...LoginLimit) (LoginReservation, error) {
+	reservation := LoginReservation{}
+	err := db.Update(func(dbStruct *DBStructure) error {
+		now := time.Now().UTC()
+		for _, limit := range limits {
+			attempt, ok := dbStruct.LoginAttempts[limit.Key]
+			if ok && attempt.LockedUntil.After(now) && attempt.LockedUntil.After(reservation.LockedUntil) {
+				reservation.LockedUntil = attempt.LockedUntil
+			}
+		}
+		if reservation.Locked() {
+			return errNothingToWrite
+		}
+		for _, limit := range limits {
+			attempt, ok := dbStruct.LoginAttempts[limit.Key]
+			if !ok {
+				attempt = LoginAttempt{Key: limit.Key}
+			}
+			put(dbStruct, &dbStruct.LoginAttempts, limit.Key, limit.Policy.record(attempt, now))
+		}
+		reservation.ReservedAt = now
+		return nil
+	})
+	if err != nil && !errors.Is(err, errNothingToWrite) {
+		return LoginReservation{}, err
+	}
+	return reservation, nil
+}
+
+// ReleaseLoginAttempt takes back the attempt reservation counted against key, along with a lockout it started.
+func (db *DB) ReleaseLoginAttempt(reservation LoginReservation, key string) error {
+	err := db.Update(func(dbStruct *DBStructure) error {
+		attempt, ok := dbStruct.LoginAttempts[key]
+		if !ok || attempt.Failures == 0 || attempt.LastFailureAt.Before(reservation.ReservedAt) {
+			return errNothingToWrite
+		}
+		put(dbStruct, &dbStruct.LoginAttempts, key, attempt.release(reservation))
+		return nil
+	})
+	if errors.Is(err, errNothingToWrite) {
+		return nil
+	}
+	return err
+}
+
+// release takes the failure counted by reservation back out of attempt.
+func (attempt LoginAttempt) release(reservation LoginReservation) LoginAttempt {
+	attempt.Failures--
+	if attempt.LastFailureAt.Equal(reservation.ReservedAt) {
+		attempt.LockedUntil = time.Time{}
+	}
+	return attempt
+}
+
+// ClearLoginFailures forgets the failed logins of key and lifts its lockout.
+func (db *DB) ClearLoginFailures(key string) error {
+	err := db.Update(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.LoginAttempts[key]; !ok {
+			return errNothingToWrite
+		}
+		remove(dbStruct, &dbStruct.LoginAttempts, key)
+		return nil
+	})
+	if errors.Is(err, errNothingToWrite) {
+		return nil
+	}
+	return err
+}
+
+// PurgeLoginAttempts forgets the failed logins that stopped counting under their policy before expiredBefore, and
+// returns how many keys were dropped.
+func (db *DB) PurgeLoginAttempts(expiredBefore time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(dbStruct *DBStructure) error {
+		for key, attempt := range dbStruct.LoginAttempts {
+			if attempt.ExpiresAt.Before(expiredBefore) && attempt.LockedUntil.Before(expiredBefore) {
+				remove(dbStruct, &dbStruct.LoginAttempts, key)
+				purged++
+			}
+		}
+		if purged == 0 {
+			return errNothingToWrite
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errNothingToWrite) {
+		return 0, err
+	}
+	return purged, nil
+}
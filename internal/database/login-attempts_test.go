@@ -0,0 +1,116 @@
+package database
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testStores opens an empty database with each of the drivers.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	dir := t.TempDir()
+	return map[string]Store{
+		DriverJSON:   openTestStore(t, DriverJSON, filepath.Join(dir, "database.json")),
+		DriverSQLite: openTestStore(t, DriverSQLite, filepath.Join(dir, "database.db")),
+	}
+}
+
+var testLockout = LockoutPolicy{MaxFailures: 5, Lockout: time.Minute, MaxLockout: time.Hour}
+
+// TestReserveLoginAttemptConcurrent makes many attempts against the same key at once. Only as many as the policy
+// allows may get through, however they interleave.
+func TestReserveLoginAttemptConcurrent(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			limit := LoginLimit{Key: "email:victim@example.com", Policy: testLockout}
+			var wg sync.WaitGroup
+			var allowed atomic.Int32
+			for range 60 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					reservation, err := db.ReserveLoginAttempt(limit)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if !reservation.Locked() {
+						allowed.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+			if got := allowed.Load(); got != int32(testLockout.MaxFailures) {
+				t.Errorf("%d attempts got through, want %d", got, testLockout.MaxFailures)
+			}
+		})
+	}
+}
+
+// TestReleaseLoginAttempt checks a successful attempt that reached the limit doesn't leave the key locked, while
+// the failures before it still count.
+func TestReleaseLoginAttempt(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			limit := LoginLimit{Key: "ip:192.0.2.1", Policy: testLockout}
+			for range testLockout.MaxFailures - 1 {
+				if _, err := db.ReserveLoginAttempt(limit); err != nil {
+					t.Fatal(err)
+				}
+			}
+			reservation, err := db.ReserveLoginAttempt(limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reservation.Locked() {
+				t.Fatal("the last allowed attempt was turned away")
+			}
+			if err := db.ReleaseLoginAttempt(reservation, limit.Key); err != nil {
+				t.Fatal(err)
+			}
+			if reservation, err = db.ReserveLoginAttempt(limit); err != nil || reservation.Locked() {
+				t.Fatalf("attempt after a released one: locked %v, error %v", reservation.Locked(), err)
+			}
+			if reservation, err = db.ReserveLoginAttempt(limit); err != nil || !reservation.Locked() {
+				t.Fatalf("attempt past the limit: locked %v, error %v", reservation.Locked(), err)
+			}
+		})
+	}
+}
+
+// TestPurgeLoginAttempts checks keys are forgotten once they stop counting under their own policy, while keys
+// recorded under a longer one keep their failures.
+func TestPurgeLoginAttempts(t *testing.T) {
+	short := LoginLimit{Key: "mfa:1", Policy: LockoutPolicy{MaxFailures: 2, Lockout: time.Second, MaxLockout: time.Second}}
+	long := LoginLimit{Key: "user:1", Policy: LockoutPolicy{MaxFailures: 2, Lockout: time.Minute, MaxLockout: time.Hour}}
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, limit := range []LoginLimit{short, long} {
+				if _, err := db.ReserveLoginAttempt(limit); err != nil {
+					t.Fatal(err)
+				}
+			}
+			purged, err := db.PurgeLoginAttempts(time.Now().Add(time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if purged != 1 {
+				t.Errorf("purged %d keys, want 1", purged)
+			}
+			for range 2 {
+				if reservation, err := db.ReserveLoginAttempt(short); err != nil || reservation.Locked() {
+					t.Fatalf("attempt on a purged key: locked %v, error %v", reservation.Locked(), err)
+				}
+			}
+			if _, err := db.ReserveLoginAttempt(long); err != nil {
+				t.Fatal(err)
+			}
+			if reservation, err := db.ReserveLoginAttempt(long); err != nil || !reservation.Locked() {
+				t.Fatalf("attempt past the limit of a kept key: locked %v, error %v", reservation.Locked(), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package database
+
+import (
+	"crypto/subtle"
+	"errors"
+	"slices"
+	"time"
+)
+
+// maxMFAChallengeAttempts is how many codes can be tried against one MFA challenge before the password has to be
+// entered again.
+const maxMFAChallengeAttempts = 5
+
+var (
+	ErrMFANotEnrolled      = errors.New("Two-factor authentication has not been set up")
+	ErrMFAEnabled          = errors.New("Two-factor authentication is already enabled")
+	ErrMFACodeInvalid      = errors.New("Two-factor code is incorrect or has already been used")
+	ErrMFAChallengeInvalid = errors.New("MFA challenge is invalid, expired or out of attempts")
+)
+
+// SetTOTPSecret starts enrolling a user in two-factor authentication, replacing an enrollment that was never
+// confirmed.
+func (db *DB) SetTOTPSecret(userID int, secret string) error {
+	return db.Update(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Users[userID]; !ok {
+			return ErrUserNotExist
+		}
+		if dbStruct.MFA[userID].Enabled {
+			return ErrMFAEnabled
+		}
+		put(dbStruct, &dbStruct.MFA, userID, MFA{UserID: userID, Secret: secret, CreatedAt: time.Now().UTC()})
+		return nil
+	})
+}
+
+func (db *DB) GetMFA(userID int) (MFA, error) {
+	var targetMFA MFA
+	err := db.View(func(dbStruct DBStructure) error {
+		mfa, ok := dbStruct.MFA[userID]
+		if !ok {
+			return ErrMFANotEnrolled
+		}
+		targetMFA = mfa
+		return nil
+	})
+	if err != nil {
+		return MFA{}, err
+	}
+	return targetMFA, nil
+}
+
+// EnableMFA confirms an enrollment with the time step of the first code entered and the digests of fresh recovery
+// codes.
+func (db *DB) EnableMFA(userID int, counter int64, recoveryCodeHashes []string) error {
+	return db.Update(func(dbStruct *DBStructure) error {
+		mfa, ok := dbStruct.MFA[userID]
+		if !ok {
+			return ErrMFANotEnrolled
+		}
+		if mfa.Enabled {
+			return ErrMFAEnabled
+		}
+		mfa.Enabled = true
+		mfa.LastCounter = counter
+		mfa.RecoveryCodes = recoveryCodeHashes
+		put(dbStruct, &dbStruct.MFA, userID, mfa)
+		return nil
+	})
+}
+
+// UseTOTPCounter records that a TOTP code for the time step counter was accepted, failing with ErrMFACodeInvalid if
+// a code for the same or a later time step was accepted before.
+func (db *DB) UseTOTPCounter(userID int, counter int64) error {
+	return db.Update(func(dbStruct *DBStructure) error {
+		mfa, ok := dbStruct.MFA[userID]
+		if !ok {
+			return ErrMFANotEnrolled
+		}
+		if counter <= mfa.LastCounter {
+			return ErrMFACodeInvalid
+		}
+		mfa.LastCounter = counter
+		put(dbStruct, &dbStruct.MFA, userID, mfa)
+		return nil
+	})
+}
+
+// UseRecoveryCode removes the recovery code with the digest codeHash, failing with ErrMFACodeInvalid if the user has
+// no such code left.
+func (db *DB) UseRecoveryCode(userID int, codeHash string) error {
+	return db.Update(func(dbStruct *DBStructure) error {
+		mfa, ok := dbStruct.MFA[userID]
+		if !ok {
+			return ErrMFANotEnrolled
+		}
+		i := slices.IndexFunc(mfa.RecoveryCodes, func(stored string) bool {
+			return subtle.ConstantTimeCompare([]byte(stored), []byte(codeHash)) == 1
+		})
+		if i < 0 {
+			return ErrMFACodeInvalid
+		}
+		mfa.RecoveryCodes = slices.Concat(mfa.RecoveryCodes[:i], mfa.RecoveryCodes[i+1:])
+		put(dbStruct, &dbStruct.MFA, userID, mfa)
+		return nil
+	})
+}
+
+// SetRecoveryCodes replaces all of a user's recovery codes.
+func (db *DB) SetRecoveryCodes(userID int, recoveryCodeHashes []string) error {
+	return db.Update(func(dbStruct *DBStructure) error {
+		mfa, ok := dbStruct.MFA[userID]
+		if !ok || !mfa.Enabled {
+			return ErrMFANotEnrolled
+		}
+		mfa.RecoveryCodes = recoveryCodeHashes
+		put(dbStruct, &dbStruct.MFA, userID, mfa)
+		return nil
+	})
+}
+
+// DisableMFA removes a user's enrollment along with their recovery codes and pending MFA challenges.
+func (db *DB) DisableMFA(userID int) error {
+	return db.Update(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.MFA[userID]; !ok {
+			return ErrMFANotEnrolled
+		}
+		remove(dbStruct, &dbStruct.MFA, userID)
+		for id, challenge := range dbStruct.MFAChallenges {
+			if challenge.UserID == userID {
+				remove(dbStruct, &dbStruct.MFAChallenges, id)
+			}
+		}
+		return nil
+	})
+}
+
+// RecordMFAChallenge remembers a challenge handed out by a password login and drops expired ones.
+func (db *DB) RecordMFAChallenge(challenge MFAChallenge) error {
+	return db.Update(func(dbStruct *DBStructure) error {
+		now := time.Now()
+		for id, pending := range dbStruct.MFAChallenges {
+			if !pending.ExpiresAt.After(now) {
+				remove(dbStruct, &dbStruct.MFAChallenges, id)
+			}
+		}
+		put(dbStruct, &dbStruct.MFAChallenges, challenge.ID, challenge)
+		return nil
+	})
+}
+
+// AttemptMFAChallenge counts an attempt at a challenge, or returns ErrMFAChallengeInvalid if it's used up.
+func (db *DB) AttemptMFAChallenge(challengeID string) error {
+	invalid := false
+	err := db.Update(func(dbStruct *DBStructure) error {
+		challenge, ok := dbStruct.MFAChallenges[challengeID]
+		if !ok {
+			return ErrMFAChallengeInvalid
+		}
+		if !challenge.ExpiresAt.After(time.Now()) || challenge.Attempts >= maxMFAChallengeAttempts {
+			remove(dbStruct, &dbStruct.MFAChallenges, challengeID)
+			invalid = true
+			return nil
+		}
+		challenge.Attempts++
+		put(dbStruct, &dbStruct.MFAChallenges, challengeID, challenge)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if invalid {
+		return ErrMFAChallengeInvalid
+	}
+	return nil
+}
+
+// DeleteMFAChallenge removes a challenge once it has been passed.
+func (db *DB) DeleteMFAChallenge(challengeID string) error {
+	err := db.Update(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.MFAChallenges[challengeID]; !ok {
+			return errNothingToWrite
+		}
+		remove(dbStruct, &dbStruct.MFAChallenges, challengeID)
+		return nil
+	})
+	if errors.Is(err, errNothingToWrite) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/samgabel/web-server/internal/auth"
+)
+
+const (
+	chirpsTable   = "chirps"
+	usersTable    = "users"
+	sessionsTable = "sessions"
+)
+
+// jsonMigrations upgrade an older database.json in place, in order, and DBStructure.Version records how many of
+// them have run. A migration must never be edited once released: append a new one instead.
+var jsonMigrations = []func(dbStruct *DBStructure) error{
+	migrateSequencesAndTombstones,
+	migrateBackfillTimestamps,
+	migrateRefreshTokensToSessions,
+	migrateUserRoles,
+	migrateVerifyExistingEmails,
+}
+
+// migrate applies every pending migration and reports whether any ran.
+func (dbStruct *DBStructure) migrate() (bool, error) {
+	if dbStruct.Version > len(jsonMigrations) {
+		return false, fmt.Errorf("Database version %d is newer than this binary supports (%d)", dbStruct.Version, len(jsonMigrations))
+	}
+	migrated := false
+	for i := dbStruct.Version; i < len(jsonMigrations); i++ {
+		if err := jsonMigrations[i](dbStruct); err != nil {
+			return false, fmt.Errorf("Migration %d failed: %w", i+1, err)
+		}
+		dbStruct.Version = i + 1
+		migrated = true
+	}
+	return migrated, nil
+}
+
+// nextID advances and returns the sequence counter for table.
+func (dbStruct *DBStructure) nextID(table string) int {
+	id := dbStruct.Sequences[table] + 1
+	put(dbStruct, &dbStruct.Sequences, table, id)
+	return id
+}
+
+// migrateSequencesAndTombstones seeds the sequence counters from the highest ID ever used, including the
+// zeroed-out entries the old DeleteChirp and DeleteRefreshToken left behind, and then removes those entries.
+func migrateSequencesAndTombstones(dbStruct *DBStructure) error {
+	if dbStruct.Sequences == nil {
+		dbStruct.Sequences = make(map[string]int)
+	}
+	for id, chirp := range dbStruct.Chirps {
+		dbStruct.Sequences[chirpsTable] = max(dbStruct.Sequences[chirpsTable], id)
+		if chirp.ID == 0 {
+			delete(dbStruct.Chirps, id)
+		}
+	}
+	for id := range dbStruct.Users {
+		dbStruct.Sequences[usersTable] = max(dbStruct.Sequences[usersTable], id)
+	}
+	for userID, refreshToken := range dbStruct.RefreshTokens {
+		if refreshToken.RefreshToken == "" {
+			delete(dbStruct.RefreshTokens, userID)
+		}
+	}
+	return nil
+}
+
+// migrateBackfillTimestamps stamps chirps and users created before records carried timestamps with the time of the
+// migration, the best estimate there is.
+func migrateBackfillTimestamps(dbStruct *DBStructure) error {
+	now := time.Now().UTC()
+	for id, chirp := range dbStruct.Chirps {
+		if chirp.CreatedAt.IsZero() {
+			chirp.CreatedAt = now
+		}
+		if chirp.UpdatedAt.IsZero() {
+			chirp.UpdatedAt = chirp.CreatedAt
+		}
+		dbStruct.Chirps[id] = chirp
+	}
+	for id, user := range dbStruct.Users {
+		if user.CreatedAt.IsZero() {
+			user.CreatedAt = now
+		}
+		if user.UpdatedAt.IsZero() {
+			user.UpdatedAt = user.CreatedAt
+		}
+		dbStruct.Users[id] = user
+	}
+	return nil
+}
+
+// migrateRefreshTokensToSessions turns each user's single refresh token into a session holding its digest.
+func migrateRefreshTokensToSessions(dbStruct *DBStructure) error {
+	if dbStruct.Sessions == nil {
+		dbStruct.Sessions = make(map[string]Session)
+	}
+	userIDs := make([]int, 0, len(dbStruct.RefreshTokens))
+	for userID := range dbStruct.RefreshTokens {
+		userIDs = append(userIDs, userID)
+	}
+	slices.Sort(userIDs)
+	for _, userID := range userIDs {
+		refreshToken := dbStruct.RefreshTokens[userID]
+		issuedAt := refreshToken.RefreshExp.Add(-refreshTokenLifetime)
+		session := Session{
+			ID:         dbStruct.nextID(sessionsTable),
+			UserID:     userID,
+			TokenHash:  auth.HashRefreshToken(refreshToken.RefreshToken),
+			CreatedAt:  issuedAt,
+			LastUsedAt: issuedAt,
+			ExpiresAt:  refreshToken.RefreshExp,
+		}
+		dbStruct.Sessions[session.TokenHash] = session
+	}
+	dbStruct.RefreshTokens = nil
+	return nil
+}
+
+// migrateUserRoles gives every existing user the default role.
+func migrateUserRoles(dbStruct *DBStructure) error {
+	for id, user := range dbStruct.Users {
+		if user.Role == "" {
+			user.Role = RoleUser
+			dbStruct.Users[id] = user
+		}
+	}
+	return nil
+}
+
+// migrateVerifyExistingEmails treats the accounts created before email verification existed as verified, so they
+// aren't locked out of anything.
+func migrateVerifyExistingEmails(dbStruct *DBStructure) error {
+	for id, user := range dbStruct.Users {
+		user.EmailVerified = true
+		dbStruct.Users[id] = user
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/samgabel/web-server/internal/auth"
+)
+
+var ErrResetTokenInvalid = errors.New("Password reset token is invalid, expired or already used")
+
+// CreatePasswordReset stores resetToken for a user's current email address, replacing their earlier reset.
+func (db *DB) CreatePasswordReset(userID int, resetToken string, lifetime time.Duration) (PasswordReset, error) {
+	var newReset PasswordReset
+	err := db.Update(func(dbStruct *DBStructure) error {
+		user, ok := dbStruct.Users[userID]
+		if !ok {
+			return ErrUserNotExist
+		}
+		now := time.Now().UTC()
+		for tokenHash, reset := range dbStruct.PasswordResets {
+			if reset.UserID == userID || !reset.ExpiresAt.After(now) {
+				remove(dbStruct, &dbStruct.PasswordResets, tokenHash)
+			}
+		}
+		newReset = PasswordReset{
+			TokenHash: auth.HashRefreshToken(resetToken),
+			UserID:    userID,
+			Email:     user.Email,
+			ExpiresAt: now.Add(lifetime),
+		}
+		put(dbStruct, &dbStruct.PasswordResets, newReset.TokenHash, newReset)
+		return nil
+	})
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	return newReset, nil
+}
+
+// GetPasswordReset looks up an unexpired reset by its token without using it up, so the new password can be checked
+// against the account first.
+func (db *DB) GetPasswordReset(resetToken string) (PasswordReset, error) {
+	var reset PasswordReset
+	err := db.View(func(dbStruct DBStructure) error {
+		var ok bool
+		reset, ok = dbStruct.PasswordResets[auth.HashRefreshToken(resetToken)]
+		if !ok || !reset.ExpiresAt.After(time.Now()) {
+			return ErrResetTokenInvalid
+		}
+		return nil
+	})
+	if err != nil {
+		return PasswordReset{}, ErrResetTokenInvalid
+	}
+	return reset, nil
+}
+
+// ResetPassword uses up resetToken to replace the user's password and signs them out everywhere.
+func (db *DB) ResetPassword(resetToken, password string) (User, error) {
+	hashedPassword, err := db.passwords.Hash(password)
+	if err != nil {
+		return User{}, err
+	}
+	var updatedUser User
+	err = db.Update(func(dbStruct *DBStructure) error {
+		reset, ok := dbStruct.PasswordResets[auth.HashRefreshToken(resetToken)]
+		if !ok || !reset.ExpiresAt.After(time.Now()) {
+			return ErrResetTokenInvalid
+		}
+		user, ok := dbStruct.Users[reset.UserID]
+		if !ok || user.Email != reset.Email {
+			return ErrResetTokenInvalid
+		}
+		remove(dbStruct, &dbStruct.PasswordResets, reset.TokenHash)
+		user.HashedPassword = hashedPassword
+		user.UpdatedAt = time.Now().UTC()
+		put(dbStruct, &dbStruct.Users, user.ID, user)
+		for tokenHash, session := range dbStruct.Sessions {
+			if session.UserID == user.ID {
+				dbStruct.deleteSession(tokenHash)
+			}
+		}
+		dbStruct.denyAccessTokens(func(token AccessToken) bool {
+			return token.UserID == user.ID
+		})
+		updatedUser = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return updatedUser, nil
+}
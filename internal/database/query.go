@@ -0,0 +1,152 @@
+package database
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// ChirpSort is a field the chirp listing can be ordered by.
+type ChirpSort string
+
+const (
+	SortByID        ChirpSort = "id"
+	SortByCreatedAt ChirpSort = "created_at"
+	// SortByRelevance is the order of SearchChirps results. ListChirps doesn't support it.
+	SortByRelevance ChirpSort = "relevance"
+)
+
+// ChirpQuery selects a page of chirps for ListChirps. Deleted chirps are never included.
+type ChirpQuery struct {
+	// AuthorIDs restricts the page to chirps by any of these authors, empty means any author.
+	AuthorIDs []int
+	// Since and Until restrict the page to chirps created in [Since, Until), a zero time leaves that end open.
+	Since time.Time
+	Until time.Time
+	// Contains restricts the page to chirps whose body contains it, ignoring case.
+	Contains string
+	// SortBy is the field the page is ordered by, ties are broken by ID. Empty means SortByID.
+	SortBy ChirpSort
+	// Descending orders the page from the highest value to the lowest.
+	Descending bool
+	// After continues a previous page from the position it ended at, nil starts from the beginning.
+	After *ChirpCursor
+	// Limit is the maximum number of chirps in the page, zero means no limit.
+	Limit int
+}
+
+// SearchQuery selects a page of chirps matching a full-text search, ranked by relevance. ChirpQuery.SortBy and
+// ChirpQuery.Descending are ignored.
+type SearchQuery struct {
+	ChirpQuery
+	// Text holds the words to look for. All of them must match, a trailing * matches any word starting with it
+	// and words in double quotes must appear as a phrase.
+	Text string
+}
+
+// ChirpCursor is the position of the last chirp of a page.
+type ChirpCursor struct {
+	ID int `json:"id"`
+	// SortBy and CreatedAt record the ordering the page was listed in and the sort key of the last chirp.
+	SortBy    ChirpSort  `json:"sort_by,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	// Offset is how many ranked search results have already been returned.
+	Offset int `json:"offset,omitempty"`
+}
+
+type ChirpPage struct {
+	Chirps []Chirp
+	// Next is the cursor to pass as ChirpQuery.After to fetch the following page, nil on the last page.
+	Next *ChirpCursor
+}
+
+func (q ChirpQuery) sortBy() ChirpSort {
+	if q.SortBy == "" {
+		return SortByID
+	}
+	return q.SortBy
+}
+
+// matches reports whether chirp belongs in the result of q, ignoring its position and limit.
+func (q ChirpQuery) matches(chirp Chirp) bool {
+	if chirp.IsDeleted() {
+		return false
+	}
+	if len(q.AuthorIDs) > 0 && !slices.Contains(q.AuthorIDs, chirp.AuthorID) {
+		return false
+	}
+	if !q.Since.IsZero() && chirp.CreatedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !chirp.CreatedAt.Before(q.Until) {
+		return false
+	}
+	return q.Contains == "" || strings.Contains(strings.ToLower(chirp.Body), strings.ToLower(q.Contains))
+}
+
+// less reports whether a comes before b in the order q asks for.
+func (q ChirpQuery) less(a, b Chirp) bool {
+	if q.Descending {
+		a, b = b, a
+	}
+	if q.sortBy() == SortByCreatedAt && !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.ID < b.ID
+}
+
+// cursorFor is the position of chirp in the order q asks for.
+func (q ChirpQuery) cursorFor(chirp Chirp) *ChirpCursor {
+	cursor := &ChirpCursor{ID: chirp.ID, SortBy: q.sortBy()}
+	if cursor.SortBy == SortByCreatedAt {
+		createdAt := chirp.CreatedAt
+		cursor.CreatedAt = &createdAt
+	}
+	return cursor
+}
+
+// afterCursor reports whether chirp comes after the cursor position in the order q asks for.
+func (q ChirpQuery) afterCursor(chirp Chirp) bool {
+	if q.After == nil {
+		return true
+	}
+	last := Chirp{ID: q.After.ID}
+	if q.After.CreatedAt != nil {
+		last.CreatedAt = *q.After.CreatedAt
+	}
+	return q.less(last, chirp)
+}
+
+// newChirpPage trims chirps, which holds up to one more than q.Limit, to the page size and sets Next if that extra
+// chirp shows there's another page.
+func newChirpPage(q ChirpQuery, chirps []Chirp) ChirpPage {
+	page := ChirpPage{Chirps: chirps}
+	if q.Limit > 0 && len(chirps) > q.Limit {
+		page.Chirps = chirps[:q.Limit]
+		page.Next = q.cursorFor(page.Chirps[q.Limit-1])
+	}
+	return page
+}
+
+// newSearchPage is newChirpPage for ranked search results, which are paged by offset since their order depends on
+// the scores rather than the ID.
+func newSearchPage(q SearchQuery, chirps []Chirp) ChirpPage {
+	page := ChirpPage{Chirps: chirps}
+	if q.Limit > 0 && len(chirps) > q.Limit {
+		page.Chirps = chirps[:q.Limit]
+		page.Next = &ChirpCursor{
+			ID:     page.Chirps[q.Limit-1].ID,
+			SortBy: SortByRelevance,
+			Offset: q.offset() + q.Limit,
+		}
+	}
+	return page
+}
+
+// offset is the number of ranked results to skip for the requested page.
+func (q SearchQuery) offset() int {
+	if q.After == nil {
+		return 0
+	}
+	return q.After.Offset
+}
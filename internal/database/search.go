@@ -0,0 +1,207 @@
+package database
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var ErrSearchQueryEmpty = errors.New("Search query has no words to look for")
+
+// BM25 parameters, the same defaults SQLite's FTS5 uses so both stores rank results alike.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// searchClause is one part of a search query that a chirp must match: a single word, a word prefix (written
+// with a trailing *) or a phrase of consecutive words (written in double quotes).
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+// parseSearch splits a search query into clauses, all of which must match.
+func parseSearch(text string) ([]searchClause, error) {
+	clauses := []searchClause{}
+	for i, part := range strings.Split(text, `"`) {
+		if i%2 == 1 {
+			if terms := tokenize(part); len(terms) > 0 {
+				clauses = append(clauses, searchClause{terms: terms})
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			terms := tokenize(word)
+			for _, term := range terms {
+				clauses = append(clauses, searchClause{terms: []string{term}})
+			}
+			if len(terms) > 0 && strings.HasSuffix(word, "*") {
+				clauses[len(clauses)-1].prefix = true
+			}
+		}
+	}
+	if len(clauses) == 0 {
+		return nil, ErrSearchQueryEmpty
+	}
+	return clauses, nil
+}
+
+// ftsMatch renders clauses in SQLite FTS5 query syntax. Terms only hold letters and digits after tokenize, so
+// quoting them is all the escaping they need.
+func ftsMatch(clauses []searchClause) string {
+	parts := make([]string, 0, len(clauses))
+	for _, clause := range clauses {
+		part := `"` + strings.Join(clause.terms, " ") + `"`
+		if clause.prefix {
+			part += "*"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// tokenize lowercases text and splits it into words on anything that isn't a letter or a digit.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchIndex is an inverted index over the bodies of every chirp that hasn't been deleted. It's kept in memory
+// next to the resident database and protected by the same lock.
+type searchIndex struct {
+	// postings maps a term to the chirps containing it and the word positions it appears at.
+	postings map[string]map[int][]int
+	// lengths holds the number of words in each indexed chirp.
+	lengths     map[int]int
+	totalLength int
+	// sortedTerms is every term in postings in order, for prefix lookups.
+	sortedTerms []string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[int][]int),
+		lengths:  make(map[int]int),
+	}
+}
+
+func (idx *searchIndex) add(chirp Chirp) {
+	idx.remove(chirp)
+	terms := tokenize(chirp.Body)
+	for pos, term := range terms {
+		docs, ok := idx.postings[term]
+		if !ok {
+			docs = make(map[int][]int)
+			idx.postings[term] = docs
+			i := sort.SearchStrings(idx.sortedTerms, term)
+			idx.sortedTerms = slices.Insert(idx.sortedTerms, i, term)
+		}
+		docs[chirp.ID] = append(docs[chirp.ID], pos)
+	}
+	idx.lengths[chirp.ID] = len(terms)
+	idx.totalLength += len(terms)
+}
+
+func (idx *searchIndex) remove(chirp Chirp) {
+	length, ok := idx.lengths[chirp.ID]
+	if !ok {
+		return
+	}
+	for _, term := range tokenize(chirp.Body) {
+		docs := idx.postings[term]
+		delete(docs, chirp.ID)
+		if len(docs) == 0 {
+			delete(idx.postings, term)
+			if i := sort.SearchStrings(idx.sortedTerms, term); i < len(idx.sortedTerms) && idx.sortedTerms[i] == term {
+				idx.sortedTerms = slices.Delete(idx.sortedTerms, i, i+1)
+			}
+		}
+	}
+	delete(idx.lengths, chirp.ID)
+	idx.totalLength -= length
+}
+
+// expand returns the terms of the index a clause word stands for: itself, or every term it's a prefix of.
+func (idx *searchIndex) expand(term string, prefix bool) []string {
+	if !prefix {
+		return []string{term}
+	}
+	expanded := []string{}
+	for i := sort.SearchStrings(idx.sortedTerms, term); i < len(idx.sortedTerms); i++ {
+		if !strings.HasPrefix(idx.sortedTerms[i], term) {
+			break
+		}
+		expanded = append(expanded, idx.sortedTerms[i])
+	}
+	return expanded
+}
+
+// matchClause returns how many times the clause occurs in each chirp that contains it.
+func (idx *searchIndex) matchClause(clause searchClause) map[int]int {
+	if len(clause.terms) == 1 {
+		matches := make(map[int]int)
+		for _, term := range idx.expand(clause.terms[0], clause.prefix) {
+			for id, positions := range idx.postings[term] {
+				matches[id] += len(positions)
+			}
+		}
+		return matches
+	}
+	matches := make(map[int]int)
+	for id, starts := range idx.postings[clause.terms[0]] {
+		count := 0
+		for _, start := range starts {
+			if idx.phraseAt(id, clause.terms[1:], start+1) {
+				count++
+			}
+		}
+		if count > 0 {
+			matches[id] = count
+		}
+	}
+	return matches
+}
+
+// phraseAt reports whether terms appear consecutively in chirp id starting at word position pos.
+func (idx *searchIndex) phraseAt(id int, terms []string, pos int) bool {
+	for i, term := range terms {
+		positions := idx.postings[term][id]
+		j := sort.SearchInts(positions, pos+i)
+		if j == len(positions) || positions[j] != pos+i {
+			return false
+		}
+	}
+	return true
+}
+
+// search scores every chirp matching all clauses with BM25 and returns the scores by chirp ID.
+func (idx *searchIndex) search(clauses []searchClause) map[int]float64 {
+	docCount := float64(len(idx.lengths))
+	if docCount == 0 {
+		return map[int]float64{}
+	}
+	avgLength := float64(idx.totalLength) / docCount
+	var scores map[int]float64
+	for _, clause := range clauses {
+		matches := idx.matchClause(clause)
+		df := float64(len(matches))
+		idf := math.Log(1 + (docCount-df+0.5)/(df+0.5))
+		clauseScores := make(map[int]float64)
+		for id, tf := range matches {
+			if scores != nil {
+				if _, ok := scores[id]; !ok {
+					continue
+				}
+			}
+			norm := bm25K1 * (1 - bm25B + bm25B*float64(idx.lengths[id])/avgLength)
+			clauseScores[id] = scores[id] + idf*float64(tf)*(bm25K1+1)/(float64(tf)+norm)
+		}
+		scores = clauseScores
+	}
+	return scores
+}
@@ -0,0 +1,90 @@
+package database
+
+import (
+	"slices"
+	"testing"
+)
+
+// TestSearchChirpsRanking searches a handful of chirps on both drivers, which have to agree on what matches and
+// in what order.
+func TestSearchChirpsRanking(t *testing.T) {
+	bodies := []string{
+		"the quick brown fox",
+		"fox fox fox jumps",
+		"a lazy dog sleeps all day long in the sun",
+		"brown dog",
+		"foxes are clever",
+		"the fox is quick and brown fox",
+	}
+	tests := []struct {
+		text    string
+		want    []int
+		ordered bool
+	}{
+		// More occurrences in fewer words rank higher.
+		{text: "fox", want: []int{2, 6, 1}, ordered: true},
+		{text: "fox*", want: []int{1, 2, 5, 6}},
+		{text: `"quick brown"`, want: []int{1}},
+		{text: "brown fox", want: []int{1, 6}},
+		{text: "cat", want: []int{}},
+	}
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, body := range bodies {
+				if _, err := db.CreateChirp(1, body); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, tt := range tests {
+				page, err := db.SearchChirps(SearchQuery{Text: tt.text})
+				if err != nil {
+					t.Fatalf("%s: %s", tt.text, err)
+				}
+				got := chirpIDs(page.Chirps)
+				if !tt.ordered {
+					slices.Sort(got)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("%s: got chirps %v, want %v", tt.text, got, tt.want)
+				}
+			}
+
+			// Paging through the results one at a time keeps the ranked order.
+			got := []int{}
+			q := SearchQuery{Text: "fox", ChirpQuery: ChirpQuery{Limit: 1}}
+			for range len(bodies) {
+				page, err := db.SearchChirps(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, chirpIDs(page.Chirps)...)
+				if page.Next == nil {
+					break
+				}
+				q.After = page.Next
+			}
+			if want := []int{2, 6, 1}; !slices.Equal(got, want) {
+				t.Errorf("paged through chirps %v, want %v", got, want)
+			}
+
+			if err := db.DeleteChirp(2, 1); err != nil {
+				t.Fatal(err)
+			}
+			page, err := db.SearchChirps(SearchQuery{Text: "fox"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := chirpIDs(page.Chirps), []int{6, 1}; !slices.Equal(got, want) {
+				t.Errorf("after deleting chirp 2 got chirps %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func chirpIDs(chirps []Chirp) []int {
+	ids := []int{}
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.ID)
+	}
+	return ids
+}
@@ -0,0 +1,155 @@
+package database
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/samgabel/web-server/internal/auth"
+)
+
+const refreshTokenLifetime = 1440 * time.Hour
+
+var (
+	ErrRefreshTokenInvalid = errors.New("No valid refresh token found, cannot generate new JWT: Expired or non-existent")
+	ErrRefreshTokenRevoke  = errors.New("No valid refresh token found, cannot revoke")
+	ErrRefreshTokenReused  = errors.New("Refresh token was already used, its session has been revoked")
+	ErrSessionNotExist     = errors.New("Session does not exist")
+)
+
+// CreateSession stores a new session for refreshToken and drops expired sessions along the way.
+func (db *DB) CreateSession(userID int, refreshToken string, device SessionDevice) (Session, error) {
+	var newSession Session
+	err := db.Update(func(dbStruct *DBStructure) error {
+		now := time.Now().UTC()
+		for tokenHash, session := range dbStruct.Sessions {
+			if !session.ExpiresAt.After(now) {
+				dbStruct.deleteSession(tokenHash)
+			}
+		}
+		newSession = Session{
+			ID:            dbStruct.nextID(sessionsTable),
+			UserID:        userID,
+			TokenHash:     auth.HashRefreshToken(refreshToken),
+			SessionDevice: device,
+			CreatedAt:     now,
+			LastUsedAt:    now,
+			ExpiresAt:     now.Add(refreshTokenLifetime),
+		}
+		put(dbStruct, &dbStruct.Sessions, newSession.TokenHash, newSession)
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	return newSession, nil
+}
+
+// ListSessions returns the unexpired sessions of a user, most recently used first.
+func (db *DB) ListSessions(userID int) ([]Session, error) {
+	sessions := []Session{}
+	err := db.View(func(dbStruct DBStructure) error {
+		now := time.Now()
+		for _, session := range dbStruct.Sessions {
+			if session.UserID == userID && session.ExpiresAt.After(now) {
+				sessions = append(sessions, session)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return []Session{}, err
+	}
+	slices.SortFunc(sessions, func(a, b Session) int {
+		return cmp.Or(b.LastUsedAt.Compare(a.LastUsedAt), cmp.Compare(b.ID, a.ID))
+	})
+	return sessions, nil
+}
+
+// DeleteSession revokes one of a user's sessions, someone else's is reported as not existing.
+func (db *DB) DeleteSession(userID, sessionID int) error {
+	return db.Update(func(dbStruct *DBStructure) error {
+		for tokenHash, session := range dbStruct.Sessions {
+			if session.ID == sessionID && session.UserID == userID {
+				dbStruct.deleteSession(tokenHash)
+				return nil
+			}
+		}
+		return ErrSessionNotExist
+	})
+}
+
+// RotateSession replaces a session's refresh token, reusing a rotated-out token revokes the whole session.
+func (db *DB) RotateSession(refreshToken, newRefreshToken string) (Session, error) {
+	var rotatedSession Session
+	reused := false
+	err := db.Update(func(dbStruct *DBStructure) error {
+		tokenHash := auth.HashRefreshToken(refreshToken)
+		now := time.Now().UTC()
+		if rotated, ok := dbStruct.RotatedTokens[tokenHash]; ok && rotated.ExpiresAt.After(now) {
+			for sessionHash, session := range dbStruct.Sessions {
+				if session.ID == rotated.SessionID {
+					dbStruct.deleteSession(sessionHash)
+					reused = true
+					return nil
+				}
+			}
+		}
+		session, ok := dbStruct.sessionForToken(refreshToken, now)
+		if !ok {
+			return ErrRefreshTokenInvalid
+		}
+		remove(dbStruct, &dbStruct.Sessions, tokenHash)
+		put(dbStruct, &dbStruct.RotatedTokens, tokenHash, RotatedToken{SessionID: session.ID, ExpiresAt: session.ExpiresAt})
+		session.TokenHash = auth.HashRefreshToken(newRefreshToken)
+		session.LastUsedAt = now
+		put(dbStruct, &dbStruct.Sessions, session.TokenHash, session)
+		rotatedSession = session
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	if reused {
+		return Session{}, ErrRefreshTokenReused
+	}
+	return rotatedSession, nil
+}
+
+func (db *DB) DeleteRefreshToken(refreshToken string) error {
+	return db.Update(func(dbStruct *DBStructure) error {
+		session, ok := dbStruct.sessionForToken(refreshToken, time.Now())
+		if !ok {
+			return ErrRefreshTokenRevoke
+		}
+		dbStruct.deleteSession(session.TokenHash)
+		return nil
+	})
+}
+
+// sessionForToken finds the unexpired session refreshToken belongs to by its digest.
+func (dbStruct *DBStructure) sessionForToken(refreshToken string, now time.Time) (Session, bool) {
+	session, ok := dbStruct.Sessions[auth.HashRefreshToken(refreshToken)]
+	if !ok || !session.ExpiresAt.After(now) {
+		return Session{}, false
+	}
+	return session, true
+}
+
+// deleteSession removes the session holding tokenHash and its rotated tokens, and denies its access tokens.
+func (dbStruct *DBStructure) deleteSession(tokenHash string) {
+	session, ok := dbStruct.Sessions[tokenHash]
+	if !ok {
+		return
+	}
+	remove(dbStruct, &dbStruct.Sessions, tokenHash)
+	for rotatedHash, rotated := range dbStruct.RotatedTokens {
+		if rotated.SessionID == session.ID {
+			remove(dbStruct, &dbStruct.RotatedTokens, rotatedHash)
+		}
+	}
+	dbStruct.denyAccessTokens(func(token AccessToken) bool {
+		return token.SessionID == session.ID
+	})
+}
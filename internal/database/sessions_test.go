@@ -0,0 +1,83 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestRotateSession rotates a refresh token twice. Each new token has to keep the session and its ID, and each old
+// one has to stop working.
+func TestRotateSession(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			session, err := db.CreateSession(1, "token-1", SessionDevice{Label: "laptop"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, tokens := range [][2]string{{"token-1", "token-2"}, {"token-2", "token-3"}} {
+				rotated, err := db.RotateSession(tokens[0], tokens[1])
+				if err != nil {
+					t.Fatalf("rotation %d: %s", i+1, err)
+				}
+				if rotated.ID != session.ID || rotated.Label != "laptop" {
+					t.Errorf("rotation %d gave session %+v, want the one created", i+1, rotated)
+				}
+			}
+			sessions, err := db.ListSessions(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 1 {
+				t.Errorf("got %d sessions, want 1", len(sessions))
+			}
+			if err := db.DeleteRefreshToken("token-2"); !errors.Is(err, ErrRefreshTokenRevoke) {
+				t.Errorf("revoking a rotated token got %v, want ErrRefreshTokenRevoke", err)
+			}
+		})
+	}
+}
+
+// TestRotateSessionReuse presents a refresh token that was already rotated out. The session has to be revoked,
+// along with the current token and the access tokens issued for it, while other sessions stay signed in.
+func TestRotateSessionReuse(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			session, err := db.CreateSession(1, "token-1", SessionDevice{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := db.CreateSession(1, "other-1", SessionDevice{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.RotateSession("token-1", "token-2"); err != nil {
+				t.Fatal(err)
+			}
+			access := AccessToken{ID: "jti-1", UserID: 1, SessionID: session.ID, ExpiresAt: session.ExpiresAt}
+			if err := db.RecordAccessToken(access); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := db.RotateSession("token-1", "token-3"); !errors.Is(err, ErrRefreshTokenReused) {
+				t.Fatalf("reusing a rotated token got %v, want ErrRefreshTokenReused", err)
+			}
+			if _, err := db.RotateSession("token-2", "token-3"); !errors.Is(err, ErrRefreshTokenInvalid) {
+				t.Errorf("current token after reuse got %v, want ErrRefreshTokenInvalid", err)
+			}
+			denied, err := db.IsAccessTokenDenied(access.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !denied {
+				t.Error("access token of the revoked session isn't denied")
+			}
+			sessions, err := db.ListSessions(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 1 || sessions[0].ID != other.ID {
+				t.Errorf("got sessions %+v, want only the other one", sessions)
+			}
+		})
+	}
+}
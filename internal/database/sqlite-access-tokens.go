@@ -0,0 +1,43 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RecordAccessToken is DB.RecordAccessToken, a trigger denies the access tokens of a deleted session.
+func (db *SQLiteDB) RecordAccessToken(token AccessToken) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		now := sqliteTime(time.Now())
+		if _, err := tx.Exec("DELETE FROM access_tokens WHERE expires_at <= ?", now); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM denied_tokens WHERE expires_at <= ?", now); err != nil {
+			return err
+		}
+		_, err := tx.Exec(
+			"INSERT INTO access_tokens (id, user_id, session_id, expires_at) VALUES (?, ?, ?, ?)",
+			token.ID, token.UserID, token.SessionID, sqliteTime(token.ExpiresAt),
+		)
+		return err
+	})
+}
+
+func (db *SQLiteDB) IsAccessTokenDenied(jti string) (bool, error) {
+	var denied bool
+	err := db.db.QueryRow("SELECT EXISTS (SELECT 1 FROM denied_tokens WHERE id = ?)", jti).Scan(&denied)
+	return denied, err
+}
+
+// sqliteDenyUserAccessTokens moves every recorded access token of a user onto the denylist.
+func sqliteDenyUserAccessTokens(tx *sql.Tx, userID int) error {
+	_, err := tx.Exec(
+		"INSERT OR REPLACE INTO denied_tokens (id, expires_at) SELECT id, expires_at FROM access_tokens WHERE user_id = ?",
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM access_tokens WHERE user_id = ?", userID)
+	return err
+}
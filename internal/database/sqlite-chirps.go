@@ -0,0 +1,238 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const sqliteChirpColumns = "id, body, author_id, created_at, updated_at, deleted_at, deleted_by"
+
+func (db *SQLiteDB) CreateChirp(authorID int, body string) (Chirp, error) {
+	now := time.Now().UTC()
+	result, err := db.db.Exec(
+		"INSERT INTO chirps (body, author_id, created_at, updated_at) VALUES (?, ?, ?, ?)",
+		body, authorID, sqliteTime(now), sqliteTime(now),
+	)
+	if err != nil {
+		return Chirp{}, err
+	}
+	newID, err := result.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+	return Chirp{
+		ID:        int(newID),
+		Body:      body,
+		AuthorID:  authorID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}, nil
+}
+
+func (db *SQLiteDB) GetChirps() ([]Chirp, error) {
+	return db.queryChirps("SELECT " + sqliteChirpColumns + " FROM chirps WHERE deleted_at IS NULL ORDER BY id")
+}
+
+func (db *SQLiteDB) ListChirps(q ChirpQuery) (ChirpPage, error) {
+	where, args := sqliteChirpFilter(q)
+	sortColumn, order, compare := "id", "ASC", ">"
+	if q.sortBy() == SortByCreatedAt {
+		sortColumn = "created_at"
+	}
+	if q.Descending {
+		order, compare = "DESC", "<"
+	}
+	if q.After != nil && q.sortBy() == SortByCreatedAt {
+		where += fmt.Sprintf(" AND (created_at %[1]s ? OR (created_at = ? AND id %[1]s ?))", compare)
+		var createdAt time.Time
+		if q.After.CreatedAt != nil {
+			createdAt = *q.After.CreatedAt
+		}
+		args = append(args, sqliteTime(createdAt), sqliteTime(createdAt), q.After.ID)
+	} else if q.After != nil {
+		where += fmt.Sprintf(" AND id %s ?", compare)
+		args = append(args, q.After.ID)
+	}
+	query := fmt.Sprintf("SELECT %s FROM chirps WHERE %s ORDER BY %s %s, id %s", sqliteChirpColumns, where, sortColumn, order, order)
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+	chirps, err := db.queryChirps(query, args...)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	return newChirpPage(q, chirps), nil
+}
+
+// SearchChirps ranks matches with FTS5's bm25(), where a lower score is a better match. Deleted chirps stay in
+// chirps_fts and are filtered out here.
+func (db *SQLiteDB) SearchChirps(q SearchQuery) (ChirpPage, error) {
+	clauses, err := parseSearch(q.Text)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	where, filterArgs := sqliteChirpFilter(q.ChirpQuery)
+	query := `SELECT ` + sqliteChirpColumns + ` FROM chirps
+		JOIN (SELECT rowid AS fts_id, bm25(chirps_fts) AS score FROM chirps_fts WHERE chirps_fts MATCH ?) ON id = fts_id
+		WHERE ` + where + ` ORDER BY score, id DESC LIMIT ? OFFSET ?`
+	limit := -1
+	if q.Limit > 0 {
+		limit = q.Limit + 1
+	}
+	args := append([]any{ftsMatch(clauses)}, filterArgs...)
+	args = append(args, limit, q.offset())
+	chirps, err := db.queryChirps(query, args...)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	return newSearchPage(q, chirps), nil
+}
+
+func (db *SQLiteDB) GetChirp(id int) (Chirp, error) {
+	chirp, err := scanChirp(db.db.QueryRow("SELECT "+sqliteChirpColumns+" FROM chirps WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotExist
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+func (db *SQLiteDB) DeleteChirp(id, deletedBy int) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		var deletedAt sql.NullTime
+		err := tx.QueryRow("SELECT deleted_at FROM chirps WHERE id = ?", id).Scan(&deletedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrChirpNotExist
+		}
+		if err != nil {
+			return err
+		}
+		if deletedAt.Valid {
+			return ErrChirpDeleted
+		}
+		now := sqliteTime(time.Now())
+		_, err = tx.Exec("UPDATE chirps SET deleted_at = ?, deleted_by = ?, updated_at = ? WHERE id = ?", now, deletedBy, now, id)
+		return err
+	})
+}
+
+func (db *SQLiteDB) RestoreChirp(id int) (Chirp, error) {
+	var restoredChirp Chirp
+	err := db.transaction(func(tx *sql.Tx) error {
+		chirp, err := scanChirp(tx.QueryRow("SELECT "+sqliteChirpColumns+" FROM chirps WHERE id = ?", id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrChirpNotExist
+		}
+		if err != nil {
+			return err
+		}
+		if !chirp.IsDeleted() {
+			return ErrChirpNotDeleted
+		}
+		now := time.Now().UTC()
+		_, err = tx.Exec("UPDATE chirps SET deleted_at = NULL, deleted_by = NULL, updated_at = ? WHERE id = ?", sqliteTime(now), id)
+		if err != nil {
+			return err
+		}
+		chirp.DeletedAt = nil
+		chirp.DeletedBy = 0
+		chirp.UpdatedAt = now
+		restoredChirp = chirp
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return restoredChirp, nil
+}
+
+func (db *SQLiteDB) PurgeChirps(deletedBefore time.Time) (int, error) {
+	result, err := db.db.Exec("DELETE FROM chirps WHERE deleted_at IS NOT NULL AND deleted_at < ?", sqliteTime(deletedBefore))
+	if err != nil {
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
+
+// sqliteChirpFilter renders the filters of q, apart from its cursor, as a WHERE clause over the chirps table.
+func sqliteChirpFilter(q ChirpQuery) (string, []any) {
+	where := []string{"deleted_at IS NULL"}
+	args := []any{}
+	if len(q.AuthorIDs) > 0 {
+		where = append(where, "author_id IN (?"+strings.Repeat(", ?", len(q.AuthorIDs)-1)+")")
+		for _, authorID := range q.AuthorIDs {
+			args = append(args, authorID)
+		}
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, sqliteTime(q.Since))
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, sqliteTime(q.Until))
+	}
+	if q.Contains != "" {
+		where = append(where, "instr(lower(body), ?) > 0")
+		args = append(args, strings.ToLower(q.Contains))
+	}
+	return strings.Join(where, " AND "), args
+}
+
+// queryChirps runs a query selecting sqliteChirpColumns and scans every row.
+func (db *SQLiteDB) queryChirps(query string, args ...any) ([]Chirp, error) {
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return []Chirp{}, err
+	}
+	defer rows.Close()
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return []Chirp{}, err
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, rows.Err()
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanChirp reads the sqliteChirpColumns of a single row.
+func scanChirp(row rowScanner) (Chirp, error) {
+	chirp := Chirp{}
+	var deletedAt sql.NullTime
+	var deletedBy sql.NullInt64
+	err := row.Scan(&chirp.ID, &chirp.Body, &chirp.AuthorID, &chirp.CreatedAt, &chirp.UpdatedAt, &deletedAt, &deletedBy)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if deletedAt.Valid {
+		chirp.DeletedAt = &deletedAt.Time
+	}
+	chirp.DeletedBy = int(deletedBy.Int64)
+	return chirp, nil
+}
+
+// expectRowAffected returns notFound if the statement behind result didn't touch any row.
+func expectRowAffected(result sql.Result, notFound error) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return notFound
+	}
+	return nil
+}
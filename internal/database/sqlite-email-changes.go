@@ -0,0 +1,82 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+func (db *SQLiteDB) RecordEmailChange(change EmailChange) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			"DELETE FROM email_changes WHERE user_id = ? OR expires_at <= ?",
+			change.UserID, sqliteTime(time.Now()),
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"INSERT INTO email_changes (id, user_id, old_email, new_email, expires_at) VALUES (?, ?, ?, ?, ?)",
+			change.ID, change.UserID, change.OldEmail, change.NewEmail, sqliteTime(change.ExpiresAt),
+		)
+		return err
+	})
+}
+
+// ConfirmEmailChange is DB.ConfirmEmailChange.
+func (db *SQLiteDB) ConfirmEmailChange(changeID string) (User, error) {
+	var changedUser User
+	var confirmErr error
+	err := db.transaction(func(tx *sql.Tx) error {
+		change := EmailChange{ID: changeID}
+		err := tx.QueryRow("SELECT user_id, old_email, new_email, expires_at FROM email_changes WHERE id = ?", changeID).
+			Scan(&change.UserID, &change.OldEmail, &change.NewEmail, &change.ExpiresAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrEmailChangeInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM email_changes WHERE id = ?", changeID); err != nil {
+			return err
+		}
+		user, err := scanUser(tx.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", change.UserID))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err != nil || !change.ExpiresAt.After(time.Now()) || user.Email != change.OldEmail {
+			confirmErr = ErrEmailChangeInvalid
+			return nil
+		}
+		var taken bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE email = ?)", change.NewEmail).Scan(&taken); err != nil {
+			return err
+		}
+		if taken {
+			confirmErr = ErrEmailRegistered
+			return nil
+		}
+		if _, err := tx.Exec("DELETE FROM email_verifications WHERE user_id = ?", user.ID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM password_resets WHERE user_id = ?", user.ID); err != nil {
+			return err
+		}
+		user.Email = change.NewEmail
+		user.EmailVerified = true
+		user.UpdatedAt = time.Now().UTC()
+		_, err = tx.Exec(
+			"UPDATE users SET email = ?, email_verified = 1, updated_at = ? WHERE id = ?",
+			user.Email, sqliteTime(user.UpdatedAt), user.ID,
+		)
+		changedUser = user
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	if confirmErr != nil {
+		return User{}, confirmErr
+	}
+	return changedUser, nil
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ReserveLoginAttempt is DB.ReserveLoginAttempt, counting attempts one at a time under the write lock.
+func (db *SQLiteDB) ReserveLoginAttempt(limits ...LoginLimit) (LoginReservation, error) {
+	reservation := LoginReservation{}
+	err := db.transaction(func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		attempts := make([]LoginAttempt, len(limits))
+		for i, limit := range limits {
+			attempts[i] = LoginAttempt{Key: limit.Key}
+			err := tx.QueryRow("SELECT failures, last_failure_at, locked_until, expires_at FROM login_attempts WHERE key = ?", limit.Key).
+				Scan(&attempts[i].Failures, &attempts[i].LastFailureAt, &attempts[i].LockedUntil, &attempts[i].ExpiresAt)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			if attempts[i].LockedUntil.After(now) && attempts[i].LockedUntil.After(reservation.LockedUntil) {
+				reservation.LockedUntil = attempts[i].LockedUntil
+			}
+		}
+		if reservation.Locked() {
+			return nil
+		}
+		for i, limit := range limits {
+			if err := sqliteSaveLoginAttempt(tx, limit.Policy.record(attempts[i], now)); err != nil {
+				return err
+			}
+		}
+		reservation.ReservedAt = now
+		return nil
+	})
+	if err != nil {
+		return LoginReservation{}, err
+	}
+	return reservation, nil
+}
+
+// ReleaseLoginAttempt is DB.ReleaseLoginAttempt.
+func (db *SQLiteDB) ReleaseLoginAttempt(reservation LoginReservation, key string) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		attempt := LoginAttempt{Key: key}
+		err := tx.QueryRow("SELECT failures, last_failure_at, locked_until, expires_at FROM login_attempts WHERE key = ?", key).
+			Scan(&attempt.Failures, &attempt.LastFailureAt, &attempt.LockedUntil, &attempt.ExpiresAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if attempt.Failures == 0 || attempt.LastFailureAt.Before(reservation.ReservedAt) {
+			return nil
+		}
+		return sqliteSaveLoginAttempt(tx, attempt.release(reservation))
+	})
+}
+
+func sqliteSaveLoginAttempt(tx *sql.Tx, attempt LoginAttempt) error {
+	_, err := tx.Exec(
+		"INSERT OR REPLACE INTO login_attempts (key, failures, last_failure_at, locked_until, expires_at) VALUES (?, ?, ?, ?, ?)",
+		attempt.Key, attempt.Failures, sqliteTime(attempt.LastFailureAt), sqliteTime(attempt.LockedUntil),
+		sqliteTime(attempt.ExpiresAt),
+	)
+	return err
+}
+
+func (db *SQLiteDB) ClearLoginFailures(key string) error {
+	_, err := db.db.Exec("DELETE FROM login_attempts WHERE key = ?", key)
+	return err
+}
+
+func (db *SQLiteDB) PurgeLoginAttempts(expiredBefore time.Time) (int, error) {
+	result, err := db.db.Exec(
+		"DELETE FROM login_attempts WHERE expires_at < ? AND locked_until < ?",
+		sqliteTime(expiredBefore), sqliteTime(expiredBefore),
+	)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
@@ -0,0 +1,195 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+func (db *SQLiteDB) SetTOTPSecret(userID int, secret string) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrUserNotExist
+		}
+		var enabled bool
+		err := tx.QueryRow("SELECT enabled FROM mfa WHERE user_id = ?", userID).Scan(&enabled)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if enabled {
+			return ErrMFAEnabled
+		}
+		_, err = tx.Exec(
+			"INSERT OR REPLACE INTO mfa (user_id, secret, enabled, last_counter, created_at) VALUES (?, ?, 0, 0, ?)",
+			userID, secret, sqliteTime(time.Now()),
+		)
+		return err
+	})
+}
+
+func (db *SQLiteDB) GetMFA(userID int) (MFA, error) {
+	mfa := MFA{UserID: userID}
+	err := db.transaction(func(tx *sql.Tx) error {
+		err := tx.QueryRow("SELECT secret, enabled, last_counter, created_at FROM mfa WHERE user_id = ?", userID).
+			Scan(&mfa.Secret, &mfa.Enabled, &mfa.LastCounter, &mfa.CreatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMFANotEnrolled
+		}
+		if err != nil {
+			return err
+		}
+		rows, err := tx.Query("SELECT code_hash FROM recovery_codes WHERE user_id = ?", userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var codeHash string
+			if err := rows.Scan(&codeHash); err != nil {
+				return err
+			}
+			mfa.RecoveryCodes = append(mfa.RecoveryCodes, codeHash)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return MFA{}, err
+	}
+	return mfa, nil
+}
+
+func (db *SQLiteDB) EnableMFA(userID int, counter int64, recoveryCodeHashes []string) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		var enabled bool
+		err := tx.QueryRow("SELECT enabled FROM mfa WHERE user_id = ?", userID).Scan(&enabled)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMFANotEnrolled
+		}
+		if err != nil {
+			return err
+		}
+		if enabled {
+			return ErrMFAEnabled
+		}
+		if _, err := tx.Exec("UPDATE mfa SET enabled = 1, last_counter = ? WHERE user_id = ?", counter, userID); err != nil {
+			return err
+		}
+		return sqliteReplaceRecoveryCodes(tx, userID, recoveryCodeHashes)
+	})
+}
+
+// UseTOTPCounter is DB.UseTOTPCounter.
+func (db *SQLiteDB) UseTOTPCounter(userID int, counter int64) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		var lastCounter int64
+		err := tx.QueryRow("SELECT last_counter FROM mfa WHERE user_id = ?", userID).Scan(&lastCounter)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMFANotEnrolled
+		}
+		if err != nil {
+			return err
+		}
+		if counter <= lastCounter {
+			return ErrMFACodeInvalid
+		}
+		_, err = tx.Exec("UPDATE mfa SET last_counter = ? WHERE user_id = ?", counter, userID)
+		return err
+	})
+}
+
+// UseRecoveryCode is DB.UseRecoveryCode.
+func (db *SQLiteDB) UseRecoveryCode(userID int, codeHash string) error {
+	result, err := db.db.Exec("DELETE FROM recovery_codes WHERE code_hash = ? AND user_id = ?", codeHash, userID)
+	if err != nil {
+		return err
+	}
+	return expectRowAffected(result, ErrMFACodeInvalid)
+}
+
+func (db *SQLiteDB) SetRecoveryCodes(userID int, recoveryCodeHashes []string) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		var enabled bool
+		err := tx.QueryRow("SELECT enabled FROM mfa WHERE user_id = ?", userID).Scan(&enabled)
+		if errors.Is(err, sql.ErrNoRows) || err == nil && !enabled {
+			return ErrMFANotEnrolled
+		}
+		if err != nil {
+			return err
+		}
+		return sqliteReplaceRecoveryCodes(tx, userID, recoveryCodeHashes)
+	})
+}
+
+func (db *SQLiteDB) DisableMFA(userID int) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		result, err := tx.Exec("DELETE FROM mfa WHERE user_id = ?", userID)
+		if err != nil {
+			return err
+		}
+		if err := expectRowAffected(result, ErrMFANotEnrolled); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM mfa_challenges WHERE user_id = ?", userID)
+		return err
+	})
+}
+
+func (db *SQLiteDB) RecordMFAChallenge(challenge MFAChallenge) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM mfa_challenges WHERE expires_at <= ?", sqliteTime(time.Now())); err != nil {
+			return err
+		}
+		_, err := tx.Exec(
+			"INSERT INTO mfa_challenges (id, user_id, attempts, expires_at) VALUES (?, ?, ?, ?)",
+			challenge.ID, challenge.UserID, challenge.Attempts, sqliteTime(challenge.ExpiresAt),
+		)
+		return err
+	})
+}
+
+// AttemptMFAChallenge is DB.AttemptMFAChallenge.
+func (db *SQLiteDB) AttemptMFAChallenge(challengeID string) error {
+	result, err := db.db.Exec(
+		"UPDATE mfa_challenges SET attempts = attempts + 1 WHERE id = ? AND attempts < ? AND expires_at > ?",
+		challengeID, maxMFAChallengeAttempts, sqliteTime(time.Now()),
+	)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		if _, err := db.db.Exec("DELETE FROM mfa_challenges WHERE id = ?", challengeID); err != nil {
+			return err
+		}
+		return ErrMFAChallengeInvalid
+	}
+	return nil
+}
+
+func (db *SQLiteDB) DeleteMFAChallenge(challengeID string) error {
+	_, err := db.db.Exec("DELETE FROM mfa_challenges WHERE id = ?", challengeID)
+	return err
+}
+
+// sqliteReplaceRecoveryCodes swaps all of a user's recovery codes for the ones with recoveryCodeHashes.
+func sqliteReplaceRecoveryCodes(tx *sql.Tx, userID int, recoveryCodeHashes []string) error {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, codeHash := range recoveryCodeHashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (code_hash, user_id) VALUES (?, ?)", codeHash, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/samgabel/web-server/internal/auth"
+)
+
+func (db *SQLiteDB) CreatePasswordReset(userID int, resetToken string, lifetime time.Duration) (PasswordReset, error) {
+	now := time.Now().UTC()
+	newReset := PasswordReset{
+		TokenHash: auth.HashRefreshToken(resetToken),
+		UserID:    userID,
+		ExpiresAt: now.Add(lifetime),
+	}
+	err := db.transaction(func(tx *sql.Tx) error {
+		err := tx.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&newReset.Email)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotExist
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM password_resets WHERE user_id = ? OR expires_at <= ?", userID, sqliteTime(now))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"INSERT INTO password_resets (token_hash, user_id, email, expires_at) VALUES (?, ?, ?, ?)",
+			newReset.TokenHash, userID, newReset.Email, sqliteTime(newReset.ExpiresAt),
+		)
+		return err
+	})
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	return newReset, nil
+}
+
+func (db *SQLiteDB) GetPasswordReset(resetToken string) (PasswordReset, error) {
+	reset := PasswordReset{}
+	err := db.db.QueryRow(
+		"SELECT token_hash, user_id, email, expires_at FROM password_resets WHERE token_hash = ? AND expires_at > ?",
+		auth.HashRefreshToken(resetToken), sqliteTime(time.Now()),
+	).Scan(&reset.TokenHash, &reset.UserID, &reset.Email, &reset.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PasswordReset{}, ErrResetTokenInvalid
+	}
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	return reset, nil
+}
+
+// ResetPassword is DB.ResetPassword, deleting sessions fires the triggers that deny their access tokens.
+func (db *SQLiteDB) ResetPassword(resetToken, password string) (User, error) {
+	hashedPassword, err := db.passwords.Hash(password)
+	if err != nil {
+		return User{}, err
+	}
+	var updatedUser User
+	err = db.transaction(func(tx *sql.Tx) error {
+		reset := PasswordReset{}
+		err := tx.QueryRow(
+			"SELECT token_hash, user_id, email FROM password_resets WHERE token_hash = ? AND expires_at > ?",
+			auth.HashRefreshToken(resetToken), sqliteTime(time.Now()),
+		).Scan(&reset.TokenHash, &reset.UserID, &reset.Email)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrResetTokenInvalid
+		}
+		if err != nil {
+			return err
+		}
+		user, err := scanUser(tx.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", reset.UserID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrResetTokenInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if user.Email != reset.Email {
+			return ErrResetTokenInvalid
+		}
+		if _, err := tx.Exec("DELETE FROM password_resets WHERE token_hash = ?", reset.TokenHash); err != nil {
+			return err
+		}
+		user.HashedPassword = hashedPassword
+		user.UpdatedAt = time.Now().UTC()
+		_, err = tx.Exec(
+			"UPDATE users SET hashed_password = ?, updated_at = ? WHERE id = ?",
+			hashedPassword, sqliteTime(user.UpdatedAt), user.ID,
+		)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", user.ID); err != nil {
+			return err
+		}
+		updatedUser = user
+		return sqliteDenyUserAccessTokens(tx, user.ID)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return updatedUser, nil
+}
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/samgabel/web-server/internal/auth"
+)
+
+const sqliteSessionColumns = "id, user_id, token_hash, device_label, user_agent, ip, created_at, last_used_at, expires_at"
+
+func (db *SQLiteDB) CreateSession(userID int, refreshToken string, device SessionDevice) (Session, error) {
+	now := time.Now().UTC()
+	newSession := Session{
+		UserID:        userID,
+		TokenHash:     auth.HashRefreshToken(refreshToken),
+		SessionDevice: device,
+		CreatedAt:     now,
+		LastUsedAt:    now,
+		ExpiresAt:     now.Add(refreshTokenLifetime),
+	}
+	err := db.transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM sessions WHERE expires_at <= ?", sqliteTime(now)); err != nil {
+			return err
+		}
+		result, err := tx.Exec(
+			`INSERT INTO sessions (user_id, token_hash, device_label, user_agent, ip, created_at, last_used_at, expires_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			userID, newSession.TokenHash, device.Label, device.UserAgent, device.IP,
+			sqliteTime(now), sqliteTime(now), sqliteTime(newSession.ExpiresAt),
+		)
+		if err != nil {
+			return err
+		}
+		newID, err := result.LastInsertId()
+		newSession.ID = int(newID)
+		return err
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	return newSession, nil
+}
+
+func (db *SQLiteDB) ListSessions(userID int) ([]Session, error) {
+	rows, err := db.db.Query(
+		"SELECT "+sqliteSessionColumns+" FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY last_used_at DESC, id DESC",
+		userID, sqliteTime(time.Now()),
+	)
+	if err != nil {
+		return []Session{}, err
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return []Session{}, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (db *SQLiteDB) DeleteSession(userID, sessionID int) error {
+	result, err := db.db.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", sessionID, userID)
+	if err != nil {
+		return err
+	}
+	return expectRowAffected(result, ErrSessionNotExist)
+}
+
+// RotateSession is DB.RotateSession, a trigger removes the rotated_tokens of a deleted session.
+func (db *SQLiteDB) RotateSession(refreshToken, newRefreshToken string) (Session, error) {
+	var rotatedSession Session
+	reused := false
+	err := db.transaction(func(tx *sql.Tx) error {
+		tokenHash := auth.HashRefreshToken(refreshToken)
+		now := time.Now().UTC()
+		result, err := tx.Exec(
+			"DELETE FROM sessions WHERE id = (SELECT session_id FROM rotated_tokens WHERE token_hash = ? AND expires_at > ?)",
+			tokenHash, sqliteTime(now),
+		)
+		if err != nil {
+			return err
+		}
+		revoked, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if revoked > 0 {
+			reused = true
+			return nil
+		}
+		session, err := sqliteSessionForToken(tx, refreshToken, now, ErrRefreshTokenInvalid)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"INSERT INTO rotated_tokens (token_hash, session_id, expires_at) VALUES (?, ?, ?)",
+			tokenHash, session.ID, sqliteTime(session.ExpiresAt),
+		)
+		if err != nil {
+			return err
+		}
+		session.TokenHash = auth.HashRefreshToken(newRefreshToken)
+		session.LastUsedAt = now
+		_, err = tx.Exec(
+			"UPDATE sessions SET token_hash = ?, last_used_at = ? WHERE id = ?",
+			session.TokenHash, sqliteTime(now), session.ID,
+		)
+		rotatedSession = session
+		return err
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	if reused {
+		return Session{}, ErrRefreshTokenReused
+	}
+	return rotatedSession, nil
+}
+
+func (db *SQLiteDB) DeleteRefreshToken(refreshToken string) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		session, err := sqliteSessionForToken(tx, refreshToken, time.Now(), ErrRefreshTokenRevoke)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM sessions WHERE id = ?", session.ID)
+		return err
+	})
+}
+
+// sqliteSessionForToken finds the unexpired session of refreshToken by its digest, or returns notFound.
+func sqliteSessionForToken(tx *sql.Tx, refreshToken string, now time.Time, notFound error) (Session, error) {
+	session, err := scanSession(tx.QueryRow(
+		"SELECT "+sqliteSessionColumns+" FROM sessions WHERE token_hash = ? AND expires_at > ?",
+		auth.HashRefreshToken(refreshToken), sqliteTime(now),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, notFound
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// scanSession reads the sqliteSessionColumns of a single row.
+func scanSession(row rowScanner) (Session, error) {
+	session := Session{}
+	err := row.Scan(
+		&session.ID, &session.UserID, &session.TokenHash,
+		&session.Label, &session.UserAgent, &session.IP,
+		&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt,
+	)
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
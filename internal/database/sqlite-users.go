@@ -0,0 +1,249 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/samgabel/web-server/internal/auth"
+)
+
+const sqliteUserColumns = "id, email, hashed_password, is_chirpy_red, role, email_verified, suspended, created_at, updated_at"
+
+func (db *SQLiteDB) CreateUser(email, password string) (User, error) {
+	hash, err := db.passwords.Hash(password)
+	if err != nil {
+		return User{}, err
+	}
+	now := time.Now().UTC()
+	newUser := User{
+		Email:           email,
+		HashedPassword:  hash,
+		ChirpyRedStatus: false,
+		Role:            RoleUser,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	err = db.transaction(func(tx *sql.Tx) error {
+		var taken bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE email = ?)", email).Scan(&taken); err != nil {
+			return err
+		}
+		if taken {
+			return ErrEmailRegistered
+		}
+		result, err := tx.Exec(
+			"INSERT INTO users (email, hashed_password, role, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+			email, hash, RoleUser, sqliteTime(now), sqliteTime(now),
+		)
+		if err != nil {
+			return err
+		}
+		newID, err := result.LastInsertId()
+		newUser.ID = int(newID)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return newUser, nil
+}
+
+func (db *SQLiteDB) AuthenticateUser(email, password string) (User, error) {
+	user, err := db.GetUserByEmail(email)
+	if errors.Is(err, ErrEmailNotExist) {
+		db.passwords.CheckDummyPassword(password)
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if err := auth.CheckPasswordHash(user.HashedPassword, password); err != nil {
+		return User{}, ErrPasswordMismatch
+	}
+	if db.passwords.NeedsRehash(user.HashedPassword) {
+		if err := db.rehashPassword(&user, password); err != nil {
+			log.Printf("Rehashing the password of user %d failed, keeping the old hash: %s", user.ID, err)
+		}
+	}
+	return user, nil
+}
+
+// rehashPassword is DB.rehashPassword.
+func (db *SQLiteDB) rehashPassword(user *User, password string) error {
+	hashedPassword, err := db.passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+	result, err := db.db.Exec(
+		"UPDATE users SET hashed_password = ? WHERE id = ? AND hashed_password = ?",
+		hashedPassword, user.ID, user.HashedPassword,
+	)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 1 {
+		user.HashedPassword = hashedPassword
+	}
+	return nil
+}
+
+// UpdateUser is DB.UpdateUser, deleting sessions fires the triggers that deny their access tokens.
+func (db *SQLiteDB) UpdateUser(userID int, update UserUpdate) (User, error) {
+	var hashedPassword []byte
+	if update.Password != nil {
+		var err error
+		if hashedPassword, err = db.passwords.Hash(*update.Password); err != nil {
+			return User{}, err
+		}
+	}
+	var newUser User
+	err := db.transaction(func(tx *sql.Tx) error {
+		user, err := scanUser(tx.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", userID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotExist
+		}
+		if err != nil {
+			return err
+		}
+		if update.Email != nil && *update.Email != user.Email {
+			var taken bool
+			if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE email = ?)", *update.Email).Scan(&taken); err != nil {
+				return err
+			}
+			if taken {
+				return ErrEmailRegistered
+			}
+			user.Email = *update.Email
+			user.EmailVerified = false
+		}
+		if hashedPassword != nil {
+			user.HashedPassword = hashedPassword
+			_, err := tx.Exec(
+				"DELETE FROM sessions WHERE user_id = ? AND id NOT IN (SELECT session_id FROM access_tokens WHERE id = ? AND user_id = ?)",
+				userID, update.CurrentTokenID, userID,
+			)
+			if err != nil {
+				return err
+			}
+			if err := sqliteDenyUserAccessTokens(tx, userID); err != nil {
+				return err
+			}
+		}
+		user.UpdatedAt = time.Now().UTC()
+		_, err = tx.Exec(
+			"UPDATE users SET email = ?, hashed_password = ?, email_verified = ?, updated_at = ? WHERE id = ?",
+			user.Email, user.HashedPassword, user.EmailVerified, sqliteTime(user.UpdatedAt), userID,
+		)
+		newUser = user
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return newUser, nil
+}
+
+func (db *SQLiteDB) UpgradeUserToRed(userID int) error {
+	result, err := db.db.Exec("UPDATE users SET is_chirpy_red = 1, updated_at = ? WHERE id = ?", sqliteTime(time.Now()), userID)
+	if err != nil {
+		return err
+	}
+	return expectRowAffected(result, ErrUserNotExist)
+}
+
+func (db *SQLiteDB) GetUser(userID int) (User, error) {
+	user, err := scanUser(db.db.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotExist
+	}
+	return user, err
+}
+
+func (db *SQLiteDB) GetUserByEmail(email string) (User, error) {
+	user, err := scanUser(db.db.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE email = ?", email))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrEmailNotExist
+	}
+	return user, err
+}
+
+// SetUserRole is DB.SetUserRole.
+func (db *SQLiteDB) SetUserRole(userID int, role Role) (User, error) {
+	var updatedUser User
+	err := db.transaction(func(tx *sql.Tx) error {
+		user, err := scanUser(tx.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", userID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotExist
+		}
+		if err != nil {
+			return err
+		}
+		updatedUser = user
+		if user.Role == role {
+			return nil
+		}
+		updatedUser.Role = role
+		updatedUser.UpdatedAt = time.Now().UTC()
+		_, err = tx.Exec(
+			"UPDATE users SET role = ?, updated_at = ? WHERE id = ?",
+			role, sqliteTime(updatedUser.UpdatedAt), userID,
+		)
+		if err != nil {
+			return err
+		}
+		return sqliteDenyUserAccessTokens(tx, userID)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return updatedUser, nil
+}
+
+// SetUserSuspended is DB.SetUserSuspended, deleting sessions fires the triggers that deny their access tokens.
+func (db *SQLiteDB) SetUserSuspended(userID int, suspended bool) (User, error) {
+	var updatedUser User
+	err := db.transaction(func(tx *sql.Tx) error {
+		user, err := scanUser(tx.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", userID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotExist
+		}
+		if err != nil {
+			return err
+		}
+		updatedUser = user
+		if user.Suspended == suspended {
+			return nil
+		}
+		updatedUser.Suspended = suspended
+		updatedUser.UpdatedAt = time.Now().UTC()
+		_, err = tx.Exec(
+			"UPDATE users SET suspended = ?, updated_at = ? WHERE id = ?",
+			suspended, sqliteTime(updatedUser.UpdatedAt), userID,
+		)
+		if err != nil || !suspended {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+		return sqliteDenyUserAccessTokens(tx, userID)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return updatedUser, nil
+}
+
+// scanUser reads the sqliteUserColumns of a single row.
+func scanUser(row rowScanner) (User, error) {
+	user := User{}
+	err := row.Scan(
+		&user.ID, &user.Email, &user.HashedPassword, &user.ChirpyRedStatus,
+		&user.Role, &user.EmailVerified, &user.Suspended, &user.CreatedAt, &user.UpdatedAt,
+	)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+func (db *SQLiteDB) RecordEmailVerification(verification EmailVerification) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM email_verifications WHERE expires_at <= ?", sqliteTime(time.Now())); err != nil {
+			return err
+		}
+		_, err := tx.Exec(
+			"INSERT INTO email_verifications (id, user_id, email, expires_at) VALUES (?, ?, ?, ?)",
+			verification.ID, verification.UserID, verification.Email, sqliteTime(verification.ExpiresAt),
+		)
+		return err
+	})
+}
+
+// VerifyEmail is DB.VerifyEmail.
+func (db *SQLiteDB) VerifyEmail(verificationID string) (User, error) {
+	var verifiedUser User
+	invalid := false
+	err := db.transaction(func(tx *sql.Tx) error {
+		verification := EmailVerification{ID: verificationID}
+		err := tx.QueryRow("SELECT user_id, email, expires_at FROM email_verifications WHERE id = ?", verificationID).
+			Scan(&verification.UserID, &verification.Email, &verification.ExpiresAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrVerificationInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM email_verifications WHERE id = ?", verificationID); err != nil {
+			return err
+		}
+		user, err := scanUser(tx.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", verification.UserID))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err != nil || !verification.ExpiresAt.After(time.Now()) || user.Email != verification.Email {
+			invalid = true
+			return nil
+		}
+		if _, err := tx.Exec("DELETE FROM email_verifications WHERE user_id = ?", user.ID); err != nil {
+			return err
+		}
+		user.EmailVerified = true
+		user.UpdatedAt = time.Now().UTC()
+		_, err = tx.Exec(
+			"UPDATE users SET email_verified = 1, updated_at = ? WHERE id = ?",
+			sqliteTime(user.UpdatedAt), user.ID,
+		)
+		verifiedUser = user
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	if invalid {
+		return User{}, ErrVerificationInvalid
+	}
+	return verifiedUser, nil
+}
@@ -0,0 +1,266 @@
+package database
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/samgabel/web-server/internal/auth"
+	"modernc.org/sqlite"
+)
+
+// SQLiteDB is a Store backed by an embedded SQLite database.
+type SQLiteDB struct {
+	db        *sql.DB
+	passwords *auth.PasswordHasher
+}
+
+// sqliteMigrations are applied in order and tracked with PRAGMA user_version, so a migration must never be
+// edited once released: append a new one instead.
+var sqliteMigrations = []string{
+	`CREATE TABLE users (
+		id              INTEGER PRIMARY KEY AUTOINCREMENT,
+		email           TEXT    NOT NULL UNIQUE,
+		hashed_password BLOB    NOT NULL,
+		is_chirpy_red   INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE chirps (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		body      TEXT    NOT NULL,
+		author_id INTEGER NOT NULL
+	);
+	CREATE INDEX chirps_author_id ON chirps (author_id);
+	CREATE TABLE refresh_tokens (
+		user_id            INTEGER   PRIMARY KEY,
+		refresh_token      TEXT      NOT NULL,
+		refresh_expiration TIMESTAMP NOT NULL
+	);
+	CREATE INDEX refresh_tokens_refresh_token ON refresh_tokens (refresh_token);`,
+	`ALTER TABLE chirps ADD COLUMN deleted_at TIMESTAMP;
+	ALTER TABLE chirps ADD COLUMN deleted_by INTEGER;
+	CREATE INDEX chirps_deleted_at ON chirps (deleted_at);`,
+	`CREATE VIRTUAL TABLE chirps_fts USING fts5 (body, content = 'chirps', content_rowid = 'id');
+	CREATE TRIGGER chirps_fts_insert AFTER INSERT ON chirps BEGIN
+		INSERT INTO chirps_fts (rowid, body) VALUES (new.id, new.body);
+	END;
+	CREATE TRIGGER chirps_fts_delete AFTER DELETE ON chirps BEGIN
+		INSERT INTO chirps_fts (chirps_fts, rowid, body) VALUES ('delete', old.id, old.body);
+	END;
+	CREATE TRIGGER chirps_fts_update AFTER UPDATE OF body ON chirps BEGIN
+		INSERT INTO chirps_fts (chirps_fts, rowid, body) VALUES ('delete', old.id, old.body);
+		INSERT INTO chirps_fts (rowid, body) VALUES (new.id, new.body);
+	END;
+	INSERT INTO chirps_fts (chirps_fts) VALUES ('rebuild');`,
+	`ALTER TABLE chirps ADD COLUMN created_at TIMESTAMP;
+	CREATE INDEX chirps_created_at ON chirps (created_at, id);`,
+	`UPDATE chirps SET created_at = coalesce(` + sqliteLegacyTime("created_at") + `, ` + sqliteNow + `);
+	UPDATE chirps SET deleted_at = ` + sqliteLegacyTime("deleted_at") + `;
+	UPDATE refresh_tokens SET refresh_expiration = ` + sqliteLegacyTime("refresh_expiration") + `;
+	ALTER TABLE chirps ADD COLUMN updated_at TIMESTAMP;
+	UPDATE chirps SET updated_at = coalesce(deleted_at, created_at);
+	ALTER TABLE users ADD COLUMN created_at TIMESTAMP;
+	ALTER TABLE users ADD COLUMN updated_at TIMESTAMP;
+	UPDATE users SET created_at = ` + sqliteNow + `, updated_at = ` + sqliteNow + `;`,
+	`CREATE TABLE sessions (
+		id           INTEGER   PRIMARY KEY AUTOINCREMENT,
+		user_id      INTEGER   NOT NULL,
+		token_hash   TEXT      NOT NULL UNIQUE,
+		device_label TEXT      NOT NULL DEFAULT '',
+		user_agent   TEXT      NOT NULL DEFAULT '',
+		ip           TEXT      NOT NULL DEFAULT '',
+		created_at   TIMESTAMP NOT NULL,
+		last_used_at TIMESTAMP NOT NULL,
+		expires_at   TIMESTAMP NOT NULL
+	);
+	CREATE INDEX sessions_user_id ON sessions (user_id);
+	INSERT INTO sessions (user_id, token_hash, created_at, last_used_at, expires_at)
+		SELECT user_id, sha256_hex(refresh_token), issued_at, issued_at, refresh_expiration FROM (
+			SELECT *, strftime('%Y-%m-%dT%H:%M:%f000000Z', refresh_expiration, '-1440 hours') AS issued_at
+			FROM refresh_tokens
+		) ORDER BY user_id;
+	DROP TABLE refresh_tokens;`,
+	`CREATE TABLE rotated_tokens (
+		token_hash TEXT      PRIMARY KEY,
+		session_id INTEGER   NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX rotated_tokens_session_id ON rotated_tokens (session_id);
+	CREATE TRIGGER sessions_delete_rotated_tokens AFTER DELETE ON sessions BEGIN
+		DELETE FROM rotated_tokens WHERE session_id = old.id;
+	END;`,
+	`CREATE TABLE access_tokens (
+		id         TEXT      PRIMARY KEY,
+		user_id    INTEGER   NOT NULL,
+		session_id INTEGER   NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX access_tokens_user_id ON access_tokens (user_id);
+	CREATE INDEX access_tokens_session_id ON access_tokens (session_id);
+	CREATE TABLE denied_tokens (
+		id         TEXT      PRIMARY KEY,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE TRIGGER sessions_deny_access_tokens AFTER DELETE ON sessions BEGIN
+		INSERT OR REPLACE INTO denied_tokens (id, expires_at)
+			SELECT id, expires_at FROM access_tokens WHERE session_id = old.id;
+		DELETE FROM access_tokens WHERE session_id = old.id;
+	END;`,
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';`,
+	`ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0;
+	UPDATE users SET email_verified = 1;
+	CREATE TABLE email_verifications (
+		id         TEXT      PRIMARY KEY,
+		user_id    INTEGER   NOT NULL,
+		email      TEXT      NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX email_verifications_user_id ON email_verifications (user_id);`,
+	`CREATE TABLE password_resets (
+		token_hash TEXT      PRIMARY KEY,
+		user_id    INTEGER   NOT NULL,
+		email      TEXT      NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX password_resets_user_id ON password_resets (user_id);`,
+	`CREATE TABLE mfa (
+		user_id      INTEGER   PRIMARY KEY,
+		secret       TEXT      NOT NULL,
+		enabled      INTEGER   NOT NULL DEFAULT 0,
+		last_counter INTEGER   NOT NULL DEFAULT 0,
+		created_at   TIMESTAMP NOT NULL
+	);
+	CREATE TABLE recovery_codes (
+		code_hash TEXT    PRIMARY KEY,
+		user_id   INTEGER NOT NULL
+	);
+	CREATE INDEX recovery_codes_user_id ON recovery_codes (user_id);
+	CREATE TABLE mfa_challenges (
+		id         TEXT      PRIMARY KEY,
+		user_id    INTEGER   NOT NULL,
+		attempts   INTEGER   NOT NULL DEFAULT 0,
+		expires_at TIMESTAMP NOT NULL
+	);`,
+	`CREATE TABLE login_attempts (
+		key             TEXT      PRIMARY KEY,
+		failures        INTEGER   NOT NULL,
+		last_failure_at TIMESTAMP NOT NULL,
+		locked_until    TIMESTAMP NOT NULL
+	);`,
+	`CREATE TABLE email_changes (
+		id         TEXT      PRIMARY KEY,
+		user_id    INTEGER   NOT NULL,
+		old_email  TEXT      NOT NULL,
+		new_email  TEXT      NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX email_changes_user_id ON email_changes (user_id);`,
+	`ALTER TABLE users ADD COLUMN suspended INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE login_attempts ADD COLUMN expires_at TIMESTAMP NOT NULL DEFAULT '0001-01-01T00:00:00.000000000Z';
+	CREATE INDEX login_attempts_expires_at ON login_attempts (expires_at);`,
+}
+
+// sqliteTimeFormat is RFC 3339 with a fixed number of fractional digits, so timestamps stored as text compare
+// correctly as strings.
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000000Z07:00"
+
+// sqliteTime formats t for storing in a TIMESTAMP column.
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+// sqliteNow is the current time in sqliteTimeFormat, as an SQL expression.
+const sqliteNow = `strftime('%Y-%m-%dT%H:%M:%f000000Z', 'now')`
+
+// sqliteLegacyTime is an SQL expression converting column from the layout the driver wrote time.Time values in
+// before sqliteTime, "2006-01-02 15:04:05.999999999 +0000 UTC", to sqliteTimeFormat. Every timestamp was stored in
+// UTC so the zone is dropped, and NULL stays NULL.
+func sqliteLegacyTime(column string) string {
+	return strings.NewReplacer("col", column).Replace(
+		`substr(col, 1, 10) || 'T' || substr(col, 12, 8) || '.' ||
+		substr(substr(col, 21, max(instr(col, ' +') - 21, 0)) || '000000000', 1, 9) || 'Z'`,
+	)
+}
+
+func init() {
+	// sha256_hex lets migrations hash refresh tokens the same way auth.HashRefreshToken does.
+	sqlite.MustRegisterDeterministicScalarFunction("sha256_hex", 1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		token, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("sha256_hex: expected text, got %T", args[0])
+		}
+		return auth.HashRefreshToken(token), nil
+	})
+}
+
+func NewSQLiteDB(path string, passwords *auth.PasswordHasher) (*SQLiteDB, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate", path)
+	sqlDB, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db := &SQLiteDB{db: sqlDB, passwords: passwords}
+	if err := db.migrate(); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *SQLiteDB) Close() error {
+	return db.db.Close()
+}
+
+// WipeDB deletes every row but keeps the schema in place.
+func (db *SQLiteDB) WipeDB() error {
+	return db.transaction(func(tx *sql.Tx) error {
+		tables := []string{
+			"email_changes", "login_attempts", "mfa_challenges", "recovery_codes", "mfa", "password_resets",
+			"email_verifications", "denied_tokens", "access_tokens", "rotated_tokens", "sessions", "chirps", "users",
+		}
+		for _, table := range tables {
+			if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec("DELETE FROM sqlite_sequence")
+		return err
+	})
+}
+
+func (db *SQLiteDB) migrate() error {
+	var version int
+	if err := db.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("Database schema version %d is newer than this binary supports (%d)", version, len(sqliteMigrations))
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		err := db.transaction(func(tx *sql.Tx) error {
+			if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+				return err
+			}
+			_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Migration %d failed: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// transaction runs fn inside a single transaction, committing if it returns nil and rolling back otherwise.
+func (db *SQLiteDB) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
+	return tx.Commit()
+}
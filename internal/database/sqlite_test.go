@@ -0,0 +1,69 @@
+package database
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSQLiteMigrateLegacy opens a database still on the first schema, with a refresh token expiring at a time in
+// the layout the driver used to write, and checks it comes out of the migrations as a session.
+func TestSQLiteMigrateLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.db")
+	legacy, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := testPasswordHasher(t).Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := []struct {
+		query string
+		args  []any
+	}{
+		{sqliteMigrations[0], nil},
+		{"PRAGMA user_version = 1", nil},
+		{"INSERT INTO users (email, hashed_password) VALUES (?, ?)", []any{"user@example.com", hash}},
+		{"INSERT INTO chirps (body, author_id) VALUES (?, ?)", []any{"an old chirp", 1}},
+		{
+			"INSERT INTO refresh_tokens (user_id, refresh_token, refresh_expiration) VALUES (?, ?, ?)",
+			[]any{1, "legacy-token", "2099-01-02 03:04:05.123456789 +0000 UTC"},
+		},
+	}
+	for _, s := range statements {
+		if _, err := legacy.Exec(s.query, s.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := legacy.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db := openTestStore(t, DriverSQLite, path)
+	if _, err := db.AuthenticateUser("user@example.com", "password"); err != nil {
+		t.Errorf("user can't log in after migrating: %s", err)
+	}
+	chirp, err := db.GetChirp(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.CreatedAt.IsZero() || !chirp.UpdatedAt.Equal(chirp.CreatedAt) {
+		t.Errorf("chirp got created_at %s and updated_at %s", chirp.CreatedAt, chirp.UpdatedAt)
+	}
+	sessions, err := db.ListSessions(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want the refresh token as 1", len(sessions))
+	}
+	wantExpiry := time.Date(2099, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	if !sessions[0].ExpiresAt.Equal(wantExpiry) {
+		t.Errorf("session expires at %s, want %s", sessions[0].ExpiresAt, wantExpiry)
+	}
+	if _, err := db.RotateSession("legacy-token", "new-token"); err != nil {
+		t.Errorf("refresh token doesn't work after migrating: %s", err)
+	}
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/samgabel/web-server/internal/auth"
+)
+
+const (
+	DriverJSON   = "json"
+	DriverSQLite = "sqlite"
+)
+
+// Store is the persistence layer the HTTP handlers are written against. DB (a single JSON file) and
+// SQLiteDB (an embedded SQLite database) are the two implementations.
+type Store interface {
+	CreateChirp(authorID int, body string) (Chirp, error)
+	GetChirps() ([]Chirp, error)
+	ListChirps(q ChirpQuery) (ChirpPage, error)
+	SearchChirps(q SearchQuery) (ChirpPage, error)
+	GetChirp(id int) (Chirp, error)
+	DeleteChirp(id, deletedBy int) error
+	RestoreChirp(id int) (Chirp, error)
+	PurgeChirps(deletedBefore time.Time) (int, error)
+
+	CreateUser(email, password string) (User, error)
+	AuthenticateUser(email, password string) (User, error)
+	UpdateUser(userID int, update UserUpdate) (User, error)
+	UpgradeUserToRed(userID int) error
+	GetUser(userID int) (User, error)
+	GetUserByEmail(email string) (User, error)
+	SetUserRole(userID int, role Role) (User, error)
+	SetUserSuspended(userID int, suspended bool) (User, error)
+	RecordEmailVerification(verification EmailVerification) error
+	VerifyEmail(verificationID string) (User, error)
+	RecordEmailChange(change EmailChange) error
+	ConfirmEmailChange(changeID string) (User, error)
+	CreatePasswordReset(userID int, resetToken string, lifetime time.Duration) (PasswordReset, error)
+	GetPasswordReset(resetToken string) (PasswordReset, error)
+	ResetPassword(resetToken, password string) (User, error)
+
+	SetTOTPSecret(userID int, secret string) error
+	GetMFA(userID int) (MFA, error)
+	EnableMFA(userID int, counter int64, recoveryCodeHashes []string) error
+	UseTOTPCounter(userID int, counter int64) error
+	UseRecoveryCode(userID int, codeHash string) error
+	SetRecoveryCodes(userID int, recoveryCodeHashes []string) error
+	DisableMFA(userID int) error
+	RecordMFAChallenge(challenge MFAChallenge) error
+	AttemptMFAChallenge(challengeID string) error
+	DeleteMFAChallenge(challengeID string) error
+
+	ReserveLoginAttempt(limits ...LoginLimit) (LoginReservation, error)
+	ReleaseLoginAttempt(reservation LoginReservation, key string) error
+	ClearLoginFailures(key string) error
+	PurgeLoginAttempts(expiredBefore time.Time) (int, error)
+
+	CreateSession(userID int, refreshToken string, device SessionDevice) (Session, error)
+	ListSessions(userID int) ([]Session, error)
+	DeleteSession(userID, sessionID int) error
+	RotateSession(refreshToken, newRefreshToken string) (Session, error)
+	DeleteRefreshToken(refreshToken string) error
+	RecordAccessToken(token AccessToken) error
+	IsAccessTokenDenied(jti string) (bool, error)
+
+	WipeDB() error
+	Close() error
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*SQLiteDB)(nil)
+)
+
+// Config selects and configures a Store implementation.
+type Config struct {
+	Driver string
+	Path   string
+	// SnapshotInterval is how often the JSON driver writes its in-memory state back to Path.
+	SnapshotInterval time.Duration
+	// Passwords hashes new passwords, and old hashes are upgraded to its parameters on login.
+	Passwords *auth.PasswordHasher
+}
+
+// Open returns the Store implementation for the configured driver.
+func Open(cfg Config) (Store, error) {
+	if cfg.Passwords == nil {
+		return nil, errors.New("Database needs a password hasher")
+	}
+	switch cfg.Driver {
+	case DriverJSON, "":
+		return NewDB(cfg.Path, cfg.SnapshotInterval, cfg.Passwords)
+	case DriverSQLite:
+		return NewSQLiteDB(cfg.Path, cfg.Passwords)
+	default:
+		return nil, fmt.Errorf("Unknown database driver %q, need %q or %q", cfg.Driver, DriverJSON, DriverSQLite)
+	}
+}
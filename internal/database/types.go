@@ -3,43 +3,211 @@ package database
 import (
 	"sync"
 	"time"
+
+	"github.com/samgabel/web-server/internal/auth"
 )
 
+// DB keeps the whole database resident in memory. Every Update is made durable through the write-ahead log and
+// the JSON file itself is only rewritten by periodic snapshots and on Close.
 type DB struct {
-	path string
-	mu   *sync.RWMutex
+	path             string
+	mu               *sync.RWMutex
+	data             DBStructure
+	index            *searchIndex
+	dirty            bool
+	walSize          int64
+	fileSize         int64
+	snapshotInterval time.Duration
+	passwords        *auth.PasswordHasher
+	stop             chan struct{}
+	stopped          chan struct{}
+	stopOnce         sync.Once
 }
 
-func NewDB(path string) (*DB, error) {
+// NewDB loads the database at path into memory. A snapshotInterval of zero or less writes the JSON file on every
+// Update instead of in the background.
+func NewDB(path string, snapshotInterval time.Duration, passwords *auth.PasswordHasher) (*DB, error) {
 	db := &DB{
-		path: path,
-		mu:   &sync.RWMutex{},
+		path:             path,
+		mu:               &sync.RWMutex{},
+		snapshotInterval: snapshotInterval,
+		passwords:        passwords,
+		stop:             make(chan struct{}),
+		stopped:          make(chan struct{}),
 	}
 	if err := db.ensureDB(); err != nil {
 		return nil, err
 	}
+	go db.snapshotLoop()
 	return db, nil
 }
 
 type DBStructure struct {
-	Chirps        map[int]Chirp        `json:"chirps"`
-	Users         map[int]User         `json:"users"`
-	RefreshTokens map[int]RefreshToken `json:"refresh_tokens"`
+	// Version is the number of jsonMigrations already applied to this file.
+	Version int `json:"version"`
+	// Sequences holds the last ID handed out per table, so IDs are never reused after a record is removed.
+	Sequences map[string]int `json:"sequences"`
+	Chirps    map[int]Chirp  `json:"chirps"`
+	Users     map[int]User   `json:"users"`
+	// Sessions is keyed by Session.TokenHash.
+	Sessions map[string]Session `json:"sessions"`
+	// RotatedTokens is keyed by the digest of a refresh token that has been replaced by a newer one.
+	RotatedTokens map[string]RotatedToken `json:"rotated_tokens"`
+	// AccessTokens and DeniedTokens are keyed by jti, DeniedTokens holds when each revoked token expires.
+	AccessTokens map[string]AccessToken `json:"access_tokens"`
+	DeniedTokens map[string]time.Time   `json:"denied_tokens"`
+	// EmailVerifications holds the verification tokens that haven't been used yet, keyed by jti.
+	EmailVerifications map[string]EmailVerification `json:"email_verifications"`
+	// EmailChanges holds the email change confirmations that haven't been used yet, keyed by jti.
+	EmailChanges map[string]EmailChange `json:"email_changes"`
+	// PasswordResets is keyed by PasswordReset.TokenHash.
+	PasswordResets map[string]PasswordReset `json:"password_resets"`
+	// MFA is keyed by user ID, MFAChallenges by jti.
+	MFA           map[int]MFA             `json:"mfa"`
+	MFAChallenges map[string]MFAChallenge `json:"mfa_challenges"`
+	// LoginAttempts is keyed by LoginAttempt.Key.
+	LoginAttempts map[string]LoginAttempt `json:"login_attempts"`
+	// RefreshTokens is the refresh token per user ID from before Sessions, only read by migrations.
+	RefreshTokens map[int]RefreshToken `json:"refresh_tokens,omitempty"`
+
+	// changes collects what put and remove do during an Update, for the write-ahead log.
+	changes *[]change
 }
 
 type Chirp struct {
-	ID       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorID int    `json:"author_id"`
+	ID        int        `json:"id"`
+	Body      string     `json:"body"`
+	AuthorID  int        `json:"author_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy int        `json:"deleted_by,omitempty"`
+}
+
+// IsDeleted reports whether the chirp is a tombstone waiting to be restored or purged.
+func (c Chirp) IsDeleted() bool {
+	return c.DeletedAt != nil
 }
 
 type User struct {
-	ID              int    `json:"id"`
-	Email           string `json:"email"`
-	HashedPassword  []byte `json:"hashed_password"`
-	ChirpyRedStatus bool   `json:"is_chirpy_red"`
+	ID              int       `json:"id"`
+	Email           string    `json:"email"`
+	HashedPassword  []byte    `json:"hashed_password"`
+	ChirpyRedStatus bool      `json:"is_chirpy_red"`
+	Role            Role      `json:"role"`
+	EmailVerified   bool      `json:"email_verified"`
+	Suspended       bool      `json:"suspended"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// UserUpdate holds the fields UpdateUser changes, a nil field is left as it is.
+type UserUpdate struct {
+	Email    *string
+	Password *string
+	// CurrentTokenID is the jti of the access token making the change, whose session survives a new password.
+	CurrentTokenID string
+}
+
+// Session is the refresh token family of one device, a refresh replaces TokenHash and keeps ID and expiry.
+type Session struct {
+	ID     int `json:"id"`
+	UserID int `json:"user_id"`
+	// TokenHash is the SHA-256 digest of the refresh token, the token itself is never stored.
+	TokenHash string `json:"token_hash"`
+	SessionDevice
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
 }
 
+// RotatedToken remembers the session of a replaced refresh token, so its reuse can be recognised.
+type RotatedToken struct {
+	SessionID int       `json:"session_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AccessToken records an access JWT issued for a session, so it can be denied before it expires.
+type AccessToken struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"user_id"`
+	SessionID int       `json:"session_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// EmailVerification is a verification token sent to Email, valid until used, expired or the address changes.
+type EmailVerification struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"user_id"`
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// EmailChange is a confirmation token sent to NewEmail, valid until used, expired or the address isn't OldEmail.
+type EmailChange struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"user_id"`
+	OldEmail  string    `json:"old_email"`
+	NewEmail  string    `json:"new_email"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// PasswordReset is a one-time token mailed to Email that lets its holder choose a new password.
+type PasswordReset struct {
+	// TokenHash is the SHA-256 digest of the reset token, the token itself is never stored.
+	TokenHash string    `json:"token_hash"`
+	UserID    int       `json:"user_id"`
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// MFA is a user's TOTP enrollment, which only takes effect once Enabled by confirming a first code.
+type MFA struct {
+	UserID int `json:"user_id"`
+	// Secret is the base32 TOTP secret.
+	Secret  string `json:"secret"`
+	Enabled bool   `json:"enabled"`
+	// LastCounter is the time step of the last TOTP code accepted, so no code can be used twice.
+	LastCounter int64 `json:"last_counter"`
+	// RecoveryCodes holds the SHA-256 digests of the recovery codes that haven't been used yet.
+	RecoveryCodes []string  `json:"recovery_codes"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// MFAChallenge is the second step of a login that's waiting for a TOTP or recovery code.
+type MFAChallenge struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"user_id"`
+	Attempts  int       `json:"attempts"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LoginAttempt tracks the recent failed logins for a key, which names the account, the client IP they came from or
+// the user whose two-factor codes were wrong.
+type LoginAttempt struct {
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"`
+	// ExpiresAt is when the failures stop counting under the policy they were recorded with.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SessionDevice describes the client a session was created from.
+type SessionDevice struct {
+	Label     string `json:"device_label"`
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+}
+
+// Role decides which actions a user is allowed to perform.
+type Role string
+
+const (
+	RoleUser  Role = "user"
+	RoleAdmin Role = "admin"
+)
+
 type RefreshToken struct {
 	RefreshToken string    `json:"refresh_token"`
 	RefreshExp   time.Time `json:"refresh_expiration"`
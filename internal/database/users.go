@@ -1,86 +1,147 @@
 package database
 
 import (
+	"bytes"
 	"errors"
+	"log"
+	"time"
 
 	"github.com/samgabel/web-server/internal/auth"
 )
 
-var ErrUserNotExist = errors.New("User does not exist")
+var (
+	ErrUserNotExist     = errors.New("User does not exist")
+	ErrEmailRegistered  = errors.New("Email is already registered, please try another email")
+	ErrEmailNotExist    = errors.New("No user associated with the provided email")
+	ErrPasswordMismatch = errors.New("Password is incorrect for given email")
+)
 
 func (db *DB) CreateUser(email, password string) (User, error) {
-	dbStruct, err := db.loadDB()
+	hash, err := db.passwords.Hash(password)
 	if err != nil {
 		return User{}, err
 	}
-	newID := len(dbStruct.Users) + 1
-	for _, user := range dbStruct.Users {
-		if user.Email == email {
-			return User{}, errors.New("Email is already registered, please try another email")
+	var newUser User
+	err = db.Update(func(dbStruct *DBStructure) error {
+		for _, user := range dbStruct.Users {
+			if user.Email == email {
+				return ErrEmailRegistered
+			}
 		}
-	}
-	hash, err := auth.HashPassword(password)
-	if err != nil {
-		return User{}, err
-	}
-	newUser := User{
-		ID:              newID,
-		Email:           email,
-		HashedPassword:  hash,
-		ChirpyRedStatus: false,
-	}
-	if dbStruct.Users == nil {
-		dbStruct.Users = make(map[int]User)
-	}
-	dbStruct.Users[newID] = newUser
-	err = db.writeDB(dbStruct)
+		newID := dbStruct.nextID(usersTable)
+		now := time.Now().UTC()
+		newUser = User{
+			ID:              newID,
+			Email:           email,
+			HashedPassword:  hash,
+			ChirpyRedStatus: false,
+			Role:            RoleUser,
+			CreatedAt:       now,
+			UpdatedAt:       now,
+		}
+		put(dbStruct, &dbStruct.Users, newID, newUser)
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 	return newUser, nil
 }
 
+// AuthenticateUser checks password against the account of email, upgrading an outdated hash on the way.
 func (db *DB) AuthenticateUser(email, password string) (User, error) {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
 	var targetUser User
-	for _, user := range dbStruct.Users {
-		if user.Email == email {
-			targetUser = user
+	err := db.View(func(dbStruct DBStructure) error {
+		for _, user := range dbStruct.Users {
+			if user.Email == email {
+				targetUser = user
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
 	}
 	if targetUser.Email == "" {
-		return User{}, errors.New("No user associated with the provided email")
+		db.passwords.CheckDummyPassword(password)
+		return User{}, ErrEmailNotExist
 	}
 	if err := auth.CheckPasswordHash(targetUser.HashedPassword, password); err != nil {
-		return User{}, errors.New("Password is incorrect for given email")
+		return User{}, ErrPasswordMismatch
+	}
+	if db.passwords.NeedsRehash(targetUser.HashedPassword) {
+		if err := db.rehashPassword(&targetUser, password); err != nil {
+			log.Printf("Rehashing the password of user %d failed, keeping the old hash: %s", targetUser.ID, err)
+		}
 	}
 	return targetUser, nil
 }
 
-func (db *DB) UpdateUser(userID int, email, password string) (User, error) {
-	dbStruct, err := db.loadDB()
+// rehashPassword stores password hashed with the current parameters, unless it was changed since it was checked.
+func (db *DB) rehashPassword(user *User, password string) error {
+	hashedPassword, err := db.passwords.Hash(password)
 	if err != nil {
-		return User{}, err
+		return err
 	}
-	hashedPassword, err := auth.HashPassword(password)
-	if err != nil {
-		return User{}, err
+	err = db.Update(func(dbStruct *DBStructure) error {
+		current, ok := dbStruct.Users[user.ID]
+		if !ok || !bytes.Equal(current.HashedPassword, user.HashedPassword) {
+			return errNothingToWrite
+		}
+		current.HashedPassword = hashedPassword
+		put(dbStruct, &dbStruct.Users, user.ID, current)
+		return nil
+	})
+	if errors.Is(err, errNothingToWrite) {
+		return nil
 	}
-	user, ok := dbStruct.Users[userID]
-	if !ok {
-		return User{}, ErrUserNotExist
+	if err == nil {
+		user.HashedPassword = hashedPassword
 	}
-	newUser := User{
-		ID:              userID,
-		Email:           email,
-		HashedPassword:  hashedPassword,
-		ChirpyRedStatus: user.ChirpyRedStatus,
+	return err
+}
+
+// UpdateUser changes the fields update sets, a new password signs the user out of every other session.
+func (db *DB) UpdateUser(userID int, update UserUpdate) (User, error) {
+	var hashedPassword []byte
+	if update.Password != nil {
+		var err error
+		if hashedPassword, err = db.passwords.Hash(*update.Password); err != nil {
+			return User{}, err
+		}
 	}
-	dbStruct.Users[userID] = newUser
-	err = db.writeDB(dbStruct)
+	var newUser User
+	err := db.Update(func(dbStruct *DBStructure) error {
+		user, ok := dbStruct.Users[userID]
+		if !ok {
+			return ErrUserNotExist
+		}
+		if update.Email != nil && *update.Email != user.Email {
+			for _, other := range dbStruct.Users {
+				if other.Email == *update.Email {
+					return ErrEmailRegistered
+				}
+			}
+			user.Email = *update.Email
+			user.EmailVerified = false
+		}
+		if hashedPassword != nil {
+			user.HashedPassword = hashedPassword
+			current, ok := dbStruct.AccessTokens[update.CurrentTokenID]
+			for tokenHash, session := range dbStruct.Sessions {
+				if session.UserID == userID && !(ok && current.UserID == userID && session.ID == current.SessionID) {
+					dbStruct.deleteSession(tokenHash)
+				}
+			}
+			dbStruct.denyAccessTokens(func(token AccessToken) bool {
+				return token.UserID == userID
+			})
+		}
+		user.UpdatedAt = time.Now().UTC()
+		put(dbStruct, &dbStruct.Users, userID, user)
+		newUser = user
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -88,23 +149,117 @@ func (db *DB) UpdateUser(userID int, email, password string) (User, error) {
 }
 
 func (db *DB) UpgradeUserToRed(userID int) error {
-	dbStruct, err := db.loadDB()
+	return db.Update(func(dbStruct *DBStructure) error {
+		user, ok := dbStruct.Users[userID]
+		if !ok {
+			return ErrUserNotExist
+		}
+		upgradedUser := User{
+			ID:              user.ID,
+			Email:           user.Email,
+			HashedPassword:  user.HashedPassword,
+			ChirpyRedStatus: true,
+			Role:            user.Role,
+			EmailVerified:   user.EmailVerified,
+			Suspended:       user.Suspended,
+			CreatedAt:       user.CreatedAt,
+			UpdatedAt:       time.Now().UTC(),
+		}
+		put(dbStruct, &dbStruct.Users, userID, upgradedUser)
+		return nil
+	})
+}
+
+func (db *DB) GetUser(userID int) (User, error) {
+	var targetUser User
+	err := db.View(func(dbStruct DBStructure) error {
+		user, ok := dbStruct.Users[userID]
+		if !ok {
+			return ErrUserNotExist
+		}
+		targetUser = user
+		return nil
+	})
 	if err != nil {
-		return err
+		return User{}, err
 	}
-	user, ok := dbStruct.Users[userID]
-	if !ok {
-		return ErrUserNotExist
+	return targetUser, nil
+}
+
+func (db *DB) GetUserByEmail(email string) (User, error) {
+	var targetUser User
+	err := db.View(func(dbStruct DBStructure) error {
+		for _, user := range dbStruct.Users {
+			if user.Email == email {
+				targetUser = user
+				return nil
+			}
+		}
+		return ErrEmailNotExist
+	})
+	if err != nil {
+		return User{}, err
 	}
-	upgradedUser := User{
-		ID:              user.ID,
-		Email:           user.Email,
-		HashedPassword:  user.HashedPassword,
-		ChirpyRedStatus: true,
+	return targetUser, nil
+}
+
+// SetUserRole changes the role of a user and denies the access tokens carrying their old scopes.
+func (db *DB) SetUserRole(userID int, role Role) (User, error) {
+	var updatedUser User
+	err := db.Update(func(dbStruct *DBStructure) error {
+		user, ok := dbStruct.Users[userID]
+		if !ok {
+			return ErrUserNotExist
+		}
+		if user.Role == role {
+			updatedUser = user
+			return errNothingToWrite
+		}
+		user.Role = role
+		user.UpdatedAt = time.Now().UTC()
+		put(dbStruct, &dbStruct.Users, userID, user)
+		dbStruct.denyAccessTokens(func(token AccessToken) bool {
+			return token.UserID == userID
+		})
+		updatedUser = user
+		return nil
+	})
+	if err != nil && !errors.Is(err, errNothingToWrite) {
+		return User{}, err
 	}
-	dbStruct.Users[userID] = upgradedUser
-	if err := db.writeDB(dbStruct); err != nil {
-		return err
+	return updatedUser, nil
+}
+
+// SetUserSuspended suspends or reinstates a user, suspending signs them out everywhere.
+func (db *DB) SetUserSuspended(userID int, suspended bool) (User, error) {
+	var updatedUser User
+	err := db.Update(func(dbStruct *DBStructure) error {
+		user, ok := dbStruct.Users[userID]
+		if !ok {
+			return ErrUserNotExist
+		}
+		if user.Suspended == suspended {
+			updatedUser = user
+			return errNothingToWrite
+		}
+		user.Suspended = suspended
+		user.UpdatedAt = time.Now().UTC()
+		put(dbStruct, &dbStruct.Users, userID, user)
+		if suspended {
+			for tokenHash, session := range dbStruct.Sessions {
+				if session.UserID == userID {
+					dbStruct.deleteSession(tokenHash)
+				}
+			}
+			dbStruct.denyAccessTokens(func(token AccessToken) bool {
+				return token.UserID == userID
+			})
+		}
+		updatedUser = user
+		return nil
+	})
+	if err != nil && !errors.Is(err, errNothingToWrite) {
+		return User{}, err
 	}
-	return nil
+	return updatedUser, nil
 }
@@ -0,0 +1,58 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrVerificationInvalid = errors.New("Verification token is invalid, expired or already used")
+
+// RecordEmailVerification remembers a verification token that has been sent out, dropping the expired ones of every
+// user along the way.
+func (db *DB) RecordEmailVerification(verification EmailVerification) error {
+	return db.Update(func(dbStruct *DBStructure) error {
+		now := time.Now()
+		for id, pending := range dbStruct.EmailVerifications {
+			if !pending.ExpiresAt.After(now) {
+				remove(dbStruct, &dbStruct.EmailVerifications, id)
+			}
+		}
+		put(dbStruct, &dbStruct.EmailVerifications, verification.ID, verification)
+		return nil
+	})
+}
+
+// VerifyEmail uses up the verification token with this jti and marks the address it was sent to as verified.
+func (db *DB) VerifyEmail(verificationID string) (User, error) {
+	var verifiedUser User
+	invalid := false
+	err := db.Update(func(dbStruct *DBStructure) error {
+		verification, ok := dbStruct.EmailVerifications[verificationID]
+		if !ok {
+			return ErrVerificationInvalid
+		}
+		remove(dbStruct, &dbStruct.EmailVerifications, verificationID)
+		user, ok := dbStruct.Users[verification.UserID]
+		if !ok || !verification.ExpiresAt.After(time.Now()) || user.Email != verification.Email {
+			invalid = true
+			return nil
+		}
+		for id, pending := range dbStruct.EmailVerifications {
+			if pending.UserID == user.ID {
+				remove(dbStruct, &dbStruct.EmailVerifications, id)
+			}
+		}
+		user.EmailVerified = true
+		user.UpdatedAt = time.Now().UTC()
+		put(dbStruct, &dbStruct.Users, user.ID, user)
+		verifiedUser = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	if invalid {
+		return User{}, ErrVerificationInvalid
+	}
+	return verifiedUser, nil
+}
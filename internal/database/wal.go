@@ -0,0 +1,285 @@
+package database
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// ErrCorrupt is returned by NewDB when the database or its write-ahead log can't be read back, so the server
+// refuses to start instead of treating the data as empty.
+var ErrCorrupt = errors.New("Database is corrupt")
+
+// walHeaderSize is the length and CRC-32 of the payload, each stored as a big-endian uint32.
+const walHeaderSize = 8
+
+func (db *DB) walPath() string {
+	return db.path + ".wal"
+}
+
+// appendWAL appends the changes of one Update to the write-ahead log and fsyncs it before returning, so the write
+// survives a crash even if the main file is never replaced. A record that fails to write is cut off again, as the
+// records appended after it would otherwise follow a torn one and make the log unreadable.
+func (db *DB) appendWAL(data []byte) error {
+	f, err := os.OpenFile(db.walPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	record := make([]byte, walHeaderSize, walHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	record = append(record, data...)
+	_, err = f.Write(record)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		if truncErr := f.Truncate(info.Size()); truncErr != nil {
+			err = errors.Join(err, fmt.Errorf("Couldn't cut off the failed write-ahead log record: %w", truncErr))
+		}
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// truncateWAL drops every record once their contents have safely reached the main file.
+func (db *DB) truncateWAL() error {
+	err := os.Truncate(db.walPath(), 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// readWAL returns the payloads of the complete records in the log, oldest first. A torn record at the very end is a
+// write that was never acknowledged and is skipped; a bad record anywhere before it is corruption.
+func (db *DB) readWAL() ([][]byte, error) {
+	data, err := os.ReadFile(db.walPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var payloads [][]byte
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < walHeaderSize {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		sum := binary.BigEndian.Uint32(data[offset+4 : offset+8])
+		end := offset + walHeaderSize + size
+		if end > len(data) {
+			break
+		}
+		payload := data[offset+walHeaderSize : end]
+		if crc32.ChecksumIEEE(payload) != sum {
+			if end == len(data) {
+				break
+			}
+			return nil, fmt.Errorf("%w: checksum mismatch in %s at offset %d", ErrCorrupt, db.walPath(), offset)
+		}
+		payloads = append(payloads, payload)
+		offset = end
+	}
+	return payloads, nil
+}
+
+// replayWAL applies the changes left in the write-ahead log to dbStruct in the order they were made, and reports
+// whether there were any. It runs on startup to recover the updates that hadn't made it into a snapshot.
+func (db *DB) replayWAL(dbStruct *DBStructure) (bool, error) {
+	payloads, err := db.readWAL()
+	if err != nil {
+		return false, err
+	}
+	for _, payload := range payloads {
+		var changes []walChange
+		if err := json.Unmarshal(payload, &changes); err != nil {
+			return false, fmt.Errorf("%w: %s: %s", ErrCorrupt, db.walPath(), err)
+		}
+		for _, c := range changes {
+			if err := dbStruct.apply(c); err != nil {
+				return false, fmt.Errorf("%w: %s: %s", ErrCorrupt, db.walPath(), err)
+			}
+		}
+	}
+	return len(payloads) > 0, nil
+}
+
+// walChange is a record put into or removed from a table, the write-ahead log holds one list of them per Update.
+type walChange struct {
+	Table   string          `json:"table"`
+	Key     json.RawMessage `json:"key"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Removed bool            `json:"removed,omitempty"`
+}
+
+// change is a walChange before it's encoded, along with how to take it back.
+type change struct {
+	table   any
+	key     any
+	value   any
+	removed bool
+	undo    func()
+}
+
+// tables maps the name of every table in the JSON file to its field in dbStruct.
+func (dbStruct *DBStructure) tables() map[string]any {
+	return map[string]any{
+		"sequences":           &dbStruct.Sequences,
+		"chirps":              &dbStruct.Chirps,
+		"users":               &dbStruct.Users,
+		"sessions":            &dbStruct.Sessions,
+		"rotated_tokens":      &dbStruct.RotatedTokens,
+		"access_tokens":       &dbStruct.AccessTokens,
+		"denied_tokens":       &dbStruct.DeniedTokens,
+		"email_verifications": &dbStruct.EmailVerifications,
+		"email_changes":       &dbStruct.EmailChanges,
+		"password_resets":     &dbStruct.PasswordResets,
+		"mfa":                 &dbStruct.MFA,
+		"mfa_challenges":      &dbStruct.MFAChallenges,
+		"login_attempts":      &dbStruct.LoginAttempts,
+	}
+}
+
+// put sets (*table)[key] to value. Update callbacks have to make every change through put and remove so it gets
+// logged, and replace values rather than modify slices they share with the table.
+func put[K comparable, V any](dbStruct *DBStructure, table *map[K]V, key K, value V) {
+	if *table == nil {
+		*table = make(map[K]V)
+	}
+	old, existed := (*table)[key]
+	(*table)[key] = value
+	dbStruct.record(change{table: table, key: key, value: value, undo: func() {
+		if existed {
+			(*table)[key] = old
+		} else {
+			delete(*table, key)
+		}
+	}})
+}
+
+// remove deletes key from *table, see put.
+func remove[K comparable, V any](dbStruct *DBStructure, table *map[K]V, key K) {
+	old, existed := (*table)[key]
+	if !existed {
+		return
+	}
+	delete(*table, key)
+	dbStruct.record(change{table: table, key: key, removed: true, undo: func() { (*table)[key] = old }})
+}
+
+func (dbStruct *DBStructure) record(c change) {
+	if dbStruct.changes != nil {
+		*dbStruct.changes = append(*dbStruct.changes, c)
+	}
+}
+
+// encodeChanges turns the changes of an Update into the payload of a write-ahead log record.
+func (dbStruct *DBStructure) encodeChanges(changes []change) ([]byte, error) {
+	names := map[any]string{}
+	for name, table := range dbStruct.tables() {
+		names[table] = name
+	}
+	encoded := make([]walChange, len(changes))
+	for i, c := range changes {
+		name, ok := names[c.table]
+		if !ok {
+			return nil, fmt.Errorf("Change to a table that isn't logged: %T", c.table)
+		}
+		key, err := json.Marshal(c.key)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = walChange{Table: name, Key: key, Removed: c.removed}
+		if !c.removed {
+			if encoded[i].Value, err = json.Marshal(c.value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return json.Marshal(encoded)
+}
+
+// rollback takes back changes, newest first.
+func rollback(changes []change) {
+	for i := len(changes) - 1; i >= 0; i-- {
+		changes[i].undo()
+	}
+}
+
+// apply makes a logged change to dbStruct.
+func (dbStruct *DBStructure) apply(c walChange) error {
+	field, ok := dbStruct.tables()[c.Table]
+	if !ok {
+		return fmt.Errorf("unknown table %q", c.Table)
+	}
+	table := reflect.ValueOf(field).Elem()
+	if table.IsNil() {
+		table.Set(reflect.MakeMap(table.Type()))
+	}
+	key := reflect.New(table.Type().Key())
+	if err := json.Unmarshal(c.Key, key.Interface()); err != nil {
+		return err
+	}
+	if c.Removed {
+		table.SetMapIndex(key.Elem(), reflect.Value{})
+		return nil
+	}
+	value := reflect.New(table.Type().Elem())
+	if err := json.Unmarshal(c.Value, value.Interface()); err != nil {
+		return err
+	}
+	table.SetMapIndex(key.Elem(), value.Elem())
+	return nil
+}
+
+// writeFileAtomic writes data to a temp file in the same directory, fsyncs it and renames it over path, so
+// readers only ever see the old or the new contents, never a partial write.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory so a rename inside it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
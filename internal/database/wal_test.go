@@ -0,0 +1,186 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// copyDB copies the JSON file and write-ahead log of the database at path into a new directory and returns the path
+// of the copy. Taken while the database is open, it's what a crash would leave on disk.
+func copyDB(t testing.TB, path string) string {
+	t.Helper()
+	copyPath := filepath.Join(t.TempDir(), filepath.Base(path))
+	for _, suffix := range []string{"", ".wal"} {
+		data, err := os.ReadFile(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(copyPath+suffix, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return copyPath
+}
+
+// seedWAL makes a user and three chirps and removes the second chirp, so the log holds puts and a remove that
+// haven't been snapshotted.
+func seedWAL(t *testing.T, path string) *DB {
+	t.Helper()
+	db := openTestDB(t, path, time.Hour)
+	if _, err := db.CreateUser("user@example.com", "password"); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"first", "second", "third"} {
+		if _, err := db.CreateChirp(1, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := db.Update(func(dbStruct *DBStructure) error {
+		remove(dbStruct, &dbStruct.Chirps, 2)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func walRecordOffsets(t *testing.T, path string) []int {
+	t.Helper()
+	db := &DB{path: path}
+	payloads, err := db.readWAL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets := []int{}
+	offset := 0
+	for _, payload := range payloads {
+		offsets = append(offsets, offset)
+		offset += walHeaderSize + len(payload)
+	}
+	return offsets
+}
+
+func assertChirpIDs(t *testing.T, db *DB, want ...int) {
+	t.Helper()
+	err := db.View(func(dbStruct DBStructure) error {
+		if len(dbStruct.Chirps) != len(want) {
+			t.Errorf("got %d chirps, want %d", len(dbStruct.Chirps), len(want))
+		}
+		for _, id := range want {
+			if _, ok := dbStruct.Chirps[id]; !ok {
+				t.Errorf("chirp %d is missing", id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWALCrashRecovery reopens a copy of a database taken while it was open, so only the log has its changes.
+func TestWALCrashRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	seedWAL(t, path)
+
+	recovered := openTestDB(t, copyDB(t, path), time.Hour)
+	assertChirpIDs(t, recovered, 1, 3)
+	if _, err := recovered.GetUser(1); err != nil {
+		t.Errorf("user wasn't recovered: %s", err)
+	}
+	chirp, err := recovered.CreateChirp(1, "fourth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.ID != 4 {
+		t.Errorf("new chirp got ID %d, want 4", chirp.ID)
+	}
+}
+
+// TestWALTornRecord cuts the last record short, as a crash in the middle of appending it would. Only that write is
+// lost.
+func TestWALTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	seedWAL(t, path)
+	copyPath := copyDB(t, path)
+	offsets := walRecordOffsets(t, copyPath)
+	info, err := os.Stat(copyPath + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastSize := int(info.Size()) - offsets[len(offsets)-1]
+	if err := os.Truncate(copyPath+".wal", info.Size()-int64(lastSize/2)); err != nil {
+		t.Fatal(err)
+	}
+
+	assertChirpIDs(t, openTestDB(t, copyPath, time.Hour), 1, 2, 3)
+}
+
+// TestWALChecksumMismatch flips a byte in a record's payload. In the last record it's a torn write and dropped, in
+// any earlier one the records after it can't be trusted and the database refuses to open.
+func TestWALChecksumMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	seedWAL(t, path)
+
+	flip := func(t *testing.T, record int) string {
+		t.Helper()
+		copyPath := copyDB(t, path)
+		offset := walRecordOffsets(t, copyPath)[record] + walHeaderSize
+		data, err := os.ReadFile(copyPath + ".wal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[offset] ^= 0xff
+		if err := os.WriteFile(copyPath+".wal", data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return copyPath
+	}
+
+	t.Run("last record", func(t *testing.T) {
+		offsets := walRecordOffsets(t, path)
+		assertChirpIDs(t, openTestDB(t, flip(t, len(offsets)-1), time.Hour), 1, 2, 3)
+	})
+	t.Run("earlier record", func(t *testing.T) {
+		_, err := NewDB(flip(t, 1), time.Hour, testPasswordHasher(t))
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("got %v, want ErrCorrupt", err)
+		}
+	})
+}
+
+// TestUpdateRollback has an Update fail after putting and removing records, none of which may stick.
+func TestUpdateRollback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := seedWAL(t, path)
+	failed := errors.New("failed")
+	err := db.Update(func(dbStruct *DBStructure) error {
+		dbStruct.nextID(chirpsTable)
+		put(dbStruct, &dbStruct.Chirps, 1, Chirp{ID: 1, Body: "changed"})
+		put(dbStruct, &dbStruct.Chirps, 2, Chirp{ID: 2, Body: "restored"})
+		remove(dbStruct, &dbStruct.Chirps, 3)
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("got %v, want the callback's error", err)
+	}
+	assertChirpIDs(t, db, 1, 3)
+	chirp, err := db.GetChirp(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Body != "first" {
+		t.Errorf("chirp 1 has body %q, want %q", chirp.Body, "first")
+	}
+	chirp, err = db.CreateChirp(1, "fourth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.ID != 4 {
+		t.Errorf("new chirp got ID %d, want 4", chirp.ID)
+	}
+}
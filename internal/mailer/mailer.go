@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails to users.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Local is a Mailer for development that writes every message to w instead of delivering it, so the links in them
+// can be followed by hand or picked up by a test.
+type Local struct {
+	mu   sync.Mutex
+	w    io.Writer
+	from string
+}
+
+// NewLocal writes messages sent from the address from to w, one at a time.
+func NewLocal(w io.Writer, from string) *Local {
+	return &Local{w: w, from: from}
+}
+
+func (l *Local) Send(msg Message) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(&sb, "From: %s\r\n", l.from)
+	fmt.Fprintf(&sb, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&sb, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&sb, "\r\n%s\r\n\r\n", msg.Body)
+	_, err := io.WriteString(l.w, sb.String())
+	return err
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/samgabel/web-server/internal/database"
+)
+
+// runPurge purges old chirp tombstones and forgotten failed logins every cfg.chirpPurgeInterval until ctx is done.
+func (cfg *apiConfig) runPurge(ctx context.Context, db database.Store) {
+	if cfg.chirpPurgeInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.chirpPurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := db.PurgeChirps(time.Now().Add(-cfg.chirpRetention))
+			if err != nil {
+				log.Printf("Purging deleted chirps failed: %s", err)
+			} else if purged > 0 {
+				log.Printf("Purged %d deleted chirps", purged)
+			}
+			if _, err := db.PurgeLoginAttempts(time.Now()); err != nil {
+				log.Printf("Purging failed logins failed: %s", err)
+			}
+		}
+	}
+}
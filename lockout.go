@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/samgabel/web-server/internal/database"
+)
+
+// errLoginFailed is the only thing a failed login reveals.
+const errLoginFailed = "Incorrect email or password"
+
+// loginAccountKey and loginIPKey name the failed login counters of a registered user and of a client address.
+func loginAccountKey(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+func loginIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+func (cfg *apiConfig) accountLimit(userID int) database.LoginLimit {
+	return database.LoginLimit{Key: loginAccountKey(userID), Policy: cfg.accountLockout}
+}
+
+func (cfg *apiConfig) ipLimit(r *http.Request) database.LoginLimit {
+	return database.LoginLimit{Key: loginIPKey(clientIP(r)), Policy: cfg.ipLockout}
+}
+
+// loginLimits are the counters a login as email from r is counted against.
+func (cfg *apiConfig) loginLimits(db database.Store, r *http.Request, email string) ([]database.LoginLimit, error) {
+	limits := []database.LoginLimit{cfg.ipLimit(r)}
+	user, err := db.GetUserByEmail(email)
+	if errors.Is(err, database.ErrEmailNotExist) {
+		return limits, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(limits, cfg.accountLimit(user.ID)), nil
+}
+
+// reserveLoginAttempt counts the attempt as failed up front, responding with 429 if any limit is locked out.
+func reserveLoginAttempt(w http.ResponseWriter, db database.Store, limits ...database.LoginLimit) (database.LoginReservation, bool) {
+	reservation, err := db.ReserveLoginAttempt(limits...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't count the login attempt: %s", err))
+		return database.LoginReservation{}, false
+	}
+	if !reservation.Locked() {
+		return reservation, true
+	}
+	wait := max(time.Until(reservation.LockedUntil), time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	respondWithError(w, http.StatusTooManyRequests, "Too many failed logins, try again later")
+	return database.LoginReservation{}, false
+}
+
+// loginSucceeded forgets the failed logins of the account and takes back the attempt reserved against the client
+// address, which keeps the failures other accounts made from it.
+func loginSucceeded(db database.Store, reservation database.LoginReservation, account, ip database.LoginLimit) error {
+	if err := db.ClearLoginFailures(account.Key); err != nil {
+		return err
+	}
+	return db.ReleaseLoginAttempt(reservation, ip.Key)
+}
+
+// releaseLoginAttempt takes back a reserved attempt whose password couldn't be checked, which isn't the client's
+// fault.
+func releaseLoginAttempt(db database.Store, reservation database.LoginReservation, limits ...database.LoginLimit) {
+	for _, limit := range limits {
+		if err := db.ReleaseLoginAttempt(reservation, limit.Key); err != nil {
+			log.Printf("Failed to release the login attempt reserved for %s: %s", limit.Key, err)
+		}
+	}
+}
+
+// clearLoginFailures forgets the failures counted against limits, responding with 500 if that fails.
+func clearLoginFailures(w http.ResponseWriter, db database.Store, limits ...database.LoginLimit) bool {
+	for _, limit := range limits {
+		if err := db.ClearLoginFailures(limit.Key); err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't clear failed logins: %s", err))
+			return false
+		}
+	}
+	return true
+}
+
+// handlerUnlockUser lifts the lockout of an account after failed logins or wrong two-factor codes.
+func handlerUnlockUser(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("userID"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+		user, err := db.GetUser(userID)
+		if errors.Is(err, database.ErrUserNotExist) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't look up the user in the database: %s", err))
+			return
+		}
+		for _, key := range []string{loginAccountKey(user.ID), mfaCodeKey(user.ID)} {
+			if err := db.ClearLoginFailures(key); err != nil {
+				respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't clear failed logins in the database: %s", err))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
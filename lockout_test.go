@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/samgabel/web-server/internal/auth"
+	"github.com/samgabel/web-server/internal/database"
+)
+
+// TestLoginMFALockout gets the password right and guesses codes, starting over with the password whenever a
+// challenge is used up. The wrong codes have to lock the account like wrong passwords do.
+func TestLoginMFALockout(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig(t)
+			login, loginMFA := cfg.handlerLogin(db), cfg.handlerLoginMFA(db)
+			const email, password = "mfa@example.com", "correct horse battery staple"
+			user, err := db.CreateUser(email, password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secret, err := auth.GenerateTOTPSecret()
+			if err != nil {
+				t.Fatal(err)
+			}
+			recoveryCodes, err := auth.GenerateRecoveryCodes(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SetTOTPSecret(user.ID, secret); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.EnableMFA(user.ID, 0, []string{auth.HashRecoveryCode(recoveryCodes[0])}); err != nil {
+				t.Fatal(err)
+			}
+			challenge := func() string {
+				t.Helper()
+				w := postJSON(t, login, map[string]string{"email": email, "password": password})
+				if w.Code != http.StatusOK {
+					return ""
+				}
+				var resp MFAChallenge
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || !resp.MFARequired {
+					t.Fatalf("login didn't ask for a second factor: %v", err)
+				}
+				return resp.MFAToken
+			}
+
+			mfaToken := challenge()
+			if mfaToken == "" {
+				t.Fatal("correct password was turned away")
+			}
+			if w := postJSON(t, loginMFA, map[string]string{"mfa_token": mfaToken, "code": recoveryCodes[0]}); w.Code != http.StatusOK {
+				t.Fatalf("correct code got status %d: %s", w.Code, w.Body)
+			}
+
+			wrongCodes := 0
+			for round := 0; round < 10; round++ {
+				mfaToken := challenge()
+				if mfaToken == "" {
+					break
+				}
+				for attempt := 0; attempt < 10; attempt++ {
+					w := postJSON(t, loginMFA, map[string]string{"mfa_token": mfaToken, "code": "aaaa-bbbb-cccc-dddd"})
+					if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), database.ErrMFACodeInvalid.Error()) {
+						break
+					}
+					wrongCodes++
+				}
+			}
+			if wrongCodes >= cfg.accountLockout.MaxFailures {
+				t.Errorf("%d wrong codes were checked, want fewer than %d", wrongCodes, cfg.accountLockout.MaxFailures)
+			}
+			w := postJSON(t, login, map[string]string{"email": email, "password": password})
+			if w.Code != http.StatusTooManyRequests {
+				t.Errorf("correct password after guessing codes got status %d, want %d", w.Code, http.StatusTooManyRequests)
+			}
+		})
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/joho/godotenv"
 	"github.com/samgabel/web-server/internal/database"
@@ -25,10 +30,13 @@ func main() {
 	mux := http.NewServeMux()
 
 	// initialize a new apiConfig
-	cfg := newAPIConfig()
+	cfg, err := newAPIConfig()
+	if err != nil {
+		log.Fatalf("Configuration failed to load: %s", err)
+	}
 
-	// initialize new database
-	db, err := database.NewDB("database.json")
+	// initialize new database with the storage backend selected by DB_DRIVER
+	db, err := database.Open(cfg.db)
 	if err != nil {
 		log.Fatalf("Database failed to initialize: %s", err)
 	}
@@ -42,20 +50,46 @@ func main() {
 		}
 	}
 
+	// create or promote the admin account configured by ADMIN_EMAIL
+	if err := cfg.bootstrapAdmin(db); err != nil {
+		log.Fatalf("Admin account failed to bootstrap: %s", err)
+	}
+
 	// register handlers
 	mux.Handle("/app/*", cfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))))
 	mux.HandleFunc("GET /api/healthz", handlerReadiness)
-	mux.HandleFunc("GET /admin/metrics", cfg.handlerMetrics)
-	mux.HandleFunc("GET /api/reset", cfg.handlerResetMetrics)
-	mux.HandleFunc("POST /api/chirps", cfg.handlerPostChirp(db))
-	mux.HandleFunc("GET /api/chirps", handlerGetChirps(db))
-	mux.HandleFunc("GET /api/chirps/{chirpID}", handlerGetChirpByID(db))
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", cfg.handlerDeleteChirpByID(db))
-	mux.HandleFunc("POST /api/users", handlerPostUser(db))
-	mux.HandleFunc("PUT /api/users", cfg.handlerUpdateUser(db))
+	mux.HandleFunc("GET /.well-known/jwks.json", cfg.handlerJWKS)
+	mux.HandleFunc("GET /admin/metrics", cfg.middlewareAuthorize(db, actionViewMetrics, http.HandlerFunc(cfg.handlerMetrics)))
+	mux.HandleFunc("GET /api/reset", cfg.middlewareAuthorize(db, actionResetMetrics, http.HandlerFunc(cfg.handlerResetMetrics)))
+	mux.HandleFunc("POST /admin/users/{userID}/promote", cfg.middlewareAuthorize(db, actionManageRoles, handlerSetUserRole(db, database.RoleAdmin)))
+	mux.HandleFunc("POST /admin/users/{userID}/demote", cfg.middlewareAuthorize(db, actionManageRoles, handlerSetUserRole(db, database.RoleUser)))
+	mux.HandleFunc("POST /admin/users/{userID}/unlock", cfg.middlewareAuthorize(db, actionUnlockUsers, handlerUnlockUser(db)))
+	mux.HandleFunc("POST /admin/users/{userID}/suspend", cfg.middlewareAuthorize(db, actionSuspendUsers, handlerSetUserSuspended(db, true)))
+	mux.HandleFunc("POST /admin/users/{userID}/unsuspend", cfg.middlewareAuthorize(db, actionSuspendUsers, handlerSetUserSuspended(db, false)))
+	mux.HandleFunc("POST /api/chirps", cfg.middlewareAuthorize(db, actionPostChirps, handlerPostChirp(db)))
+	mux.HandleFunc("GET /api/chirps", cfg.middlewareOptionalAuth(db, handlerGetChirps(db)))
+	mux.HandleFunc("GET /api/chirps/search", cfg.middlewareOptionalAuth(db, handlerSearchChirps(db)))
+	mux.HandleFunc("GET /api/chirps/{chirpID}", cfg.middlewareOptionalAuth(db, handlerGetChirpByID(db)))
+	mux.HandleFunc("DELETE /api/chirps/{chirpID}", cfg.middlewareAuthorize(db, actionWriteChirps, handlerDeleteChirpByID(db)))
+	mux.HandleFunc("POST /api/chirps/{chirpID}/restore", cfg.middlewareAuthorize(db, actionWriteChirps, cfg.handlerRestoreChirpByID(db)))
+	mux.HandleFunc("POST /api/users", cfg.handlerPostUser(db))
+	mux.HandleFunc("PUT /api/users", cfg.middlewareRequireAuth(db, cfg.handlerPutUser(db)))
+	mux.HandleFunc("PATCH /api/users", cfg.middlewareRequireAuth(db, cfg.handlerPatchUser(db)))
+	mux.HandleFunc("POST /api/users/email/confirm", cfg.handlerConfirmEmailChange(db))
+	mux.HandleFunc("POST /api/users/verify", cfg.handlerVerifyEmail(db))
+	mux.HandleFunc("POST /api/users/verify/resend", cfg.middlewareRequireAuth(db, cfg.handlerResendEmailVerification(db)))
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin(db))
+	mux.HandleFunc("POST /api/login/mfa", cfg.handlerLoginMFA(db))
+	mux.HandleFunc("POST /api/mfa/totp", cfg.middlewareRequireAuth(db, handlerEnrollTOTP(db)))
+	mux.HandleFunc("POST /api/mfa/totp/confirm", cfg.middlewareRequireAuth(db, handlerConfirmTOTP(db)))
+	mux.HandleFunc("DELETE /api/mfa/totp", cfg.middlewareRequireAuth(db, cfg.handlerDisableTOTP(db)))
+	mux.HandleFunc("POST /api/mfa/recovery-codes", cfg.middlewareRequireAuth(db, cfg.handlerRegenerateRecoveryCodes(db)))
+	mux.HandleFunc("POST /api/password/forgot", cfg.handlerForgotPassword(db))
+	mux.HandleFunc("POST /api/password/reset", cfg.handlerResetPassword(db))
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh(db))
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevokeRefresh(db))
+	mux.HandleFunc("GET /api/sessions", cfg.middlewareRequireAuth(db, handlerGetSessions(db)))
+	mux.HandleFunc("DELETE /api/sessions/{sessionID}", cfg.middlewareRequireAuth(db, handlerDeleteSession(db)))
 	mux.HandleFunc("POST /api/polka/webhooks", cfg.handlerChirpyRedConfirmation(db))
 
 	// initialize new server
@@ -64,6 +98,29 @@ func main() {
 		Handler: middlewareLogging(mux),
 	}
 
+	// shut down gracefully on SIGINT/SIGTERM so the database gets flushed to disk
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// periodically remove deleted chirps once their retention period is over, and failed logins that no longer count
+	go cfg.runPurge(ctx, db)
+
+	idle := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			log.Printf("Server shutdown failed: %s", err)
+		}
+		close(idle)
+	}()
+
 	log.Printf("Serving on %s\n", srv.Addr)
-	log.Fatal(srv.ListenAndServe())
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-idle
+	if err := db.Close(); err != nil {
+		log.Fatalf("Database failed to flush on shutdown: %s", err)
+	}
+	log.Println("Server stopped")
 }
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/samgabel/web-server/internal/auth"
+	"github.com/samgabel/web-server/internal/database"
+)
+
+const (
+	// mfaChallengeLifetime is how long a user has to enter their second factor after getting their password right.
+	mfaChallengeLifetime = 5 * time.Minute
+	recoveryCodeCount    = 10
+)
+
+// respondWithMFAChallenge hands out the token a user whose password was correct completes their login with.
+func (cfg *apiConfig) respondWithMFAChallenge(w http.ResponseWriter, db database.Store, user database.User) {
+	mfaToken, claims, err := auth.NewMFAChallengeToken(user.ID, cfg.jwtKeys, mfaChallengeLifetime)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("MFA challenge could not be created: %s", err))
+		return
+	}
+	err = db.RecordMFAChallenge(database.MFAChallenge{
+		ID:        claims.ID,
+		UserID:    user.ID,
+		ExpiresAt: claims.ExpiresAt.Time,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("MFA challenge could not be stored: %s", err))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, MFAChallenge{
+		MFARequired: true,
+		MFAToken:    mfaToken,
+		ExpiresAt:   claims.ExpiresAt.Time,
+	})
+}
+
+// handlerLoginMFA completes a login with the token from the MFAChallenge and a TOTP or recovery code.
+func (cfg *apiConfig) handlerLoginMFA(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type parameters struct {
+			MFAToken         string `json:"mfa_token"`
+			Code             string `json:"code"`
+			ExpiresInSeconds *int   `json:"expires_in_seconds"`
+			DeviceLabel      string `json:"device_label"`
+		}
+		params := parameters{}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+			return
+		}
+		claims, err := auth.VerifyMFAChallengeToken(params.MFAToken, cfg.jwtKeys)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Invalid MFA token: %s", err))
+			return
+		}
+		user, err := db.GetUser(claims.UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't look up the user in the database: %s", err))
+			return
+		}
+		limits := cfg.mfaCodeLimits(user.ID)
+		reservation, ok := reserveLoginAttempt(w, db, limits...)
+		if !ok {
+			return
+		}
+		err = db.AttemptMFAChallenge(claims.ID)
+		if err == nil {
+			err = checkMFACode(db, user.ID, params.Code)
+		}
+		if errors.Is(err, database.ErrMFACodeInvalid) {
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			releaseLoginAttempt(db, reservation, limits...)
+		}
+		if errors.Is(err, database.ErrMFAChallengeInvalid) {
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			respondWithMFAError(w, err)
+			return
+		}
+		if !clearLoginFailures(w, db, limits...) {
+			return
+		}
+		if err := db.DeleteMFAChallenge(claims.ID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't remove the MFA challenge: %s", err))
+			return
+		}
+		cfg.signIn(w, r, db, user, params.DeviceLabel, params.ExpiresInSeconds)
+	}
+}
+
+// checkMFACode accepts a current TOTP code that hasn't been used yet, or one of the user's remaining recovery codes,
+// which is used up.
+func checkMFACode(db database.Store, userID int, code string) error {
+	mfa, err := db.GetMFA(userID)
+	if err != nil {
+		return err
+	}
+	if !mfa.Enabled {
+		return database.ErrMFANotEnrolled
+	}
+	if !auth.IsTOTPCode(code) {
+		return db.UseRecoveryCode(userID, auth.HashRecoveryCode(code))
+	}
+	counter, err := auth.CheckTOTP(mfa.Secret, code, time.Now())
+	if err != nil {
+		return database.ErrMFACodeInvalid
+	}
+	return db.UseTOTPCounter(userID, counter)
+}
+
+// mfaCodeKey names the counter of wrong two-factor codes given for a user.
+func mfaCodeKey(userID int) string {
+	return "mfa:" + strconv.Itoa(userID)
+}
+
+// mfaCodeLimits are the counters a two-factor code of a user is checked against.
+func (cfg *apiConfig) mfaCodeLimits(userID int) []database.LoginLimit {
+	return []database.LoginLimit{
+		{Key: mfaCodeKey(userID), Policy: cfg.accountLockout},
+		cfg.accountLimit(userID),
+	}
+}
+
+// checkMFACodeLimited is checkMFACode with wrong codes locked out like failed logins.
+func (cfg *apiConfig) checkMFACodeLimited(w http.ResponseWriter, db database.Store, userID int, code string) bool {
+	limits := cfg.mfaCodeLimits(userID)
+	reservation, ok := reserveLoginAttempt(w, db, limits...)
+	if !ok {
+		return false
+	}
+	err := checkMFACode(db, userID, code)
+	if errors.Is(err, database.ErrMFACodeInvalid) {
+		respondWithMFAError(w, err)
+		return false
+	}
+	if err != nil {
+		releaseLoginAttempt(db, reservation, limits...)
+		respondWithMFAError(w, err)
+		return false
+	}
+	return clearLoginFailures(w, db, limits...)
+}
+
+// respondWithMFAError responds to a signed in user whose request to manage two-factor authentication failed.
+func respondWithMFAError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, database.ErrMFACodeInvalid):
+		respondWithError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, database.ErrMFANotEnrolled):
+		respondWithError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, database.ErrMFAEnabled):
+		respondWithError(w, http.StatusConflict, err.Error())
+	default:
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Two-factor authentication failed in the database: %s", err))
+	}
+}
+
+// handlerEnrollTOTP generates a TOTP secret for the signed in user, enabled once handlerConfirmTOTP confirms it.
+func handlerEnrollTOTP(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := db.GetUser(principal(r).UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't look up the user in the database: %s", err))
+			return
+		}
+		secret, err := auth.GenerateTOTPSecret()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("TOTP secret could not be created: %s", err))
+			return
+		}
+		if err := db.SetTOTPSecret(user.ID, secret); err != nil {
+			respondWithMFAError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusCreated, TOTPEnrollment{
+			Secret:          secret,
+			ProvisioningURI: auth.TOTPProvisioningURI(secret, user.Email),
+		})
+	}
+}
+
+// handlerConfirmTOTP enables two-factor authentication with the first code from the authenticator app, and responds
+// with the recovery codes.
+func handlerConfirmTOTP(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type parameters struct {
+			Code string `json:"code"`
+		}
+		params := parameters{}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+			return
+		}
+		userID := principal(r).UserID
+		mfa, err := db.GetMFA(userID)
+		if err != nil {
+			respondWithMFAError(w, err)
+			return
+		}
+		if mfa.Enabled {
+			respondWithMFAError(w, database.ErrMFAEnabled)
+			return
+		}
+		counter, err := auth.CheckTOTP(mfa.Secret, params.Code, time.Now())
+		if err != nil {
+			respondWithMFAError(w, database.ErrMFACodeInvalid)
+			return
+		}
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Recovery codes could not be created: %s", err))
+			return
+		}
+		if err := db.EnableMFA(userID, counter, hashes); err != nil {
+			respondWithMFAError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, RecoveryCodes{RecoveryCodes: codes})
+	}
+}
+
+// handlerDisableTOTP turns two-factor authentication off, which takes a current TOTP or recovery code.
+func (cfg *apiConfig) handlerDisableTOTP(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type parameters struct {
+			Code string `json:"code"`
+		}
+		params := parameters{}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+			return
+		}
+		userID := principal(r).UserID
+		if !cfg.checkMFACodeLimited(w, db, userID, params.Code) {
+			return
+		}
+		if err := db.DisableMFA(userID); err != nil {
+			respondWithMFAError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handlerRegenerateRecoveryCodes replaces all recovery codes with new ones, which takes a current TOTP or recovery
+// code.
+func (cfg *apiConfig) handlerRegenerateRecoveryCodes(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type parameters struct {
+			Code string `json:"code"`
+		}
+		params := parameters{}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+			return
+		}
+		userID := principal(r).UserID
+		if !cfg.checkMFACodeLimited(w, db, userID, params.Code) {
+			return
+		}
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Recovery codes could not be created: %s", err))
+			return
+		}
+		if err := db.SetRecoveryCodes(userID, hashes); err != nil {
+			respondWithMFAError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, RecoveryCodes{RecoveryCodes: codes})
+	}
+}
+
+// newRecoveryCodes returns a fresh set of recovery codes along with the digests to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
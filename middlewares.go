@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
+
+	"github.com/samgabel/web-server/internal/auth"
+	"github.com/samgabel/web-server/internal/database"
 )
 
 func middlewareLogging(next http.Handler) http.HandlerFunc {
@@ -18,3 +24,70 @@ func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.HandlerFunc {
 		next.ServeHTTP(w, r)
 	}
 }
+
+// principalKey is the request context key the verified access token claims are stored under.
+type principalKey struct{}
+
+// principal returns the claims of the access token the request was authenticated with, or nil when it wasn't.
+func principal(r *http.Request) *auth.Claims {
+	claims, _ := r.Context().Value(principalKey{}).(*auth.Claims)
+	return claims
+}
+
+// middlewareRequireAuth only lets requests through with a valid bearer access token carrying every one of scopes,
+// and makes its claims available to next through principal.
+func (cfg *apiConfig) middlewareRequireAuth(db database.Store, next http.Handler, scopes ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="chirpy"`)
+			respondWithError(w, http.StatusUnauthorized, "Missing Authorization request header")
+			return
+		}
+		claims, ok := cfg.authenticate(db, w, r)
+		if !ok {
+			return
+		}
+		for _, scope := range scopes {
+			if !claims.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="chirpy", error="insufficient_scope", scope=%q`, scope))
+				respondWithError(w, http.StatusForbidden, fmt.Sprintf("Token is missing the %s scope", scope))
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, claims)))
+	}
+}
+
+// middlewareOptionalAuth lets anonymous requests through, but a request that does send a bearer access token is
+// rejected unless the token is valid.
+func (cfg *apiConfig) middlewareOptionalAuth(db database.Store, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		claims, ok := cfg.authenticate(db, w, r)
+		if !ok {
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, claims)))
+	}
+}
+
+// authenticate verifies the bearer access token of a request, responding with the error and reporting false if
+// it's malformed or invalid.
+func (cfg *apiConfig) authenticate(db database.Store, w http.ResponseWriter, r *http.Request) (*auth.Claims, bool) {
+	requestJWT, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chirpy", error="invalid_request"`)
+		respondWithError(w, http.StatusBadRequest, "Malformed Authorization request header")
+		return nil, false
+	}
+	claims, err := auth.VerifySignedJWT(requestJWT, cfg.jwtKeys, db)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="chirpy", error="invalid_token", error_description=%q`, err.Error()))
+		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Unauthorized attempt to login using JWT: %s", err))
+		return nil, false
+	}
+	return claims, true
+}
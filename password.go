@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/samgabel/web-server/internal/auth"
+	"github.com/samgabel/web-server/internal/database"
+	"github.com/samgabel/web-server/internal/mailer"
+)
+
+// checkPassword responds with 422 and every rule password breaks, and reports false, unless the account with email
+// may use it.
+func (cfg *apiConfig) checkPassword(w http.ResponseWriter, password, email string) bool {
+	violations := cfg.passwordPolicy.Check(password, email)
+	if len(violations) == 0 {
+		return true
+	}
+	type errorResponse struct {
+		Error       string                   `json:"error"`
+		FailedRules []auth.PasswordViolation `json:"failed_rules"`
+	}
+	respondWithJSON(w, http.StatusUnprocessableEntity, errorResponse{
+		Error:       "Password doesn't meet the password policy",
+		FailedRules: violations,
+	})
+	return false
+}
+
+// handlerForgotPassword mails a password reset token, responding the same whether the email is registered or not.
+func (cfg *apiConfig) handlerForgotPassword(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type parameters struct {
+			Email string `json:"email"`
+		}
+		params := parameters{}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+			return
+		}
+		user, err := db.GetUserByEmail(params.Email)
+		if errors.Is(err, database.ErrEmailNotExist) {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't look up the user in the database: %s", err))
+			return
+		}
+		if err := cfg.sendPasswordReset(db, user); err != nil {
+			log.Printf("Password reset email to user %d failed: %s", user.ID, err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// sendPasswordReset mails user a one-time token to choose a new password with.
+func (cfg *apiConfig) sendPasswordReset(db database.Store, user database.User) error {
+	resetToken, err := auth.GeneratePasswordResetToken()
+	if err != nil {
+		return err
+	}
+	if _, err := db.CreatePasswordReset(user.ID, resetToken, cfg.passwordResetTTL); err != nil {
+		return err
+	}
+	return cfg.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf(
+			"Send this token with your new password to POST /api/password/reset within %s to reset it:\r\n\r\n%s\r\n\r\n"+
+				"If you didn't ask to reset your password you can ignore this email.",
+			cfg.passwordResetTTL, resetToken,
+		),
+	})
+}
+
+// handlerResetPassword sets a new password with a token from handlerForgotPassword and signs the user out of every
+// session.
+func (cfg *apiConfig) handlerResetPassword(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type parameters struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
+		params := parameters{}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+			return
+		}
+		reset, err := db.GetPasswordReset(params.Token)
+		if errors.Is(err, database.ErrResetTokenInvalid) {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't look up the password reset in the database: %s", err))
+			return
+		}
+		if !cfg.checkPassword(w, params.Password, reset.Email) {
+			return
+		}
+		if _, err := db.ResetPassword(params.Token, params.Password); err != nil {
+			if errors.Is(err, database.ErrResetTokenInvalid) {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't reset the password in the database: %s", err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
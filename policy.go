@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/samgabel/web-server/internal/auth"
+	"github.com/samgabel/web-server/internal/database"
+)
+
+// action is something a route does on behalf of the caller, which the policy decides who is allowed to do.
+type action string
+
+const (
+	actionPostChirps   action = "chirps:post"
+	actionWriteChirps  action = "chirps:write"
+	actionViewMetrics  action = "metrics:view"
+	actionResetMetrics action = "metrics:reset"
+	actionManageRoles  action = "users:roles"
+	actionUnlockUsers  action = "users:unlock"
+	actionSuspendUsers action = "users:suspend"
+)
+
+// policy maps every action to the role required to perform it.
+var policy = map[action]database.Role{
+	actionPostChirps:   database.RoleUser,
+	actionWriteChirps:  database.RoleUser,
+	actionViewMetrics:  database.RoleAdmin,
+	actionResetMetrics: database.RoleAdmin,
+	actionManageRoles:  database.RoleAdmin,
+	actionUnlockUsers:  database.RoleAdmin,
+	actionSuspendUsers: database.RoleAdmin,
+}
+
+// verifiedEmailActions additionally require a verified email address when REQUIRE_EMAIL_VERIFICATION is on.
+var verifiedEmailActions = map[action]bool{
+	actionPostChirps: true,
+}
+
+// roleScopes are the scopes granted to access tokens per role, each including those of the roles below it.
+var roleScopes = map[database.Role][]string{
+	database.RoleUser:  {auth.ScopeChirpsWrite},
+	database.RoleAdmin: {auth.ScopeChirpsWrite, auth.ScopeAdmin},
+}
+
+// middlewareAuthorize only lets requests through whose access token was issued to a user with the role policy
+// requires for act, and whose email address is verified if act calls for it.
+func (cfg *apiConfig) middlewareAuthorize(db database.Store, act action, next http.Handler) http.HandlerFunc {
+	role, ok := policy[act]
+	if !ok {
+		panic(fmt.Sprintf("No policy for action %q", act))
+	}
+	if cfg.requireVerifiedEmail && verifiedEmailActions[act] {
+		next = middlewareRequireVerifiedEmail(db, next)
+	}
+	return cfg.middlewareRequireAuth(db, next, roleScopes[role]...)
+}
+
+// middlewareRequireVerifiedEmail looks up the authenticated user and rejects them if their email isn't verified.
+func middlewareRequireVerifiedEmail(db database.Store, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := db.GetUser(principal(r).UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't look up the user in the database: %s", err))
+			return
+		}
+		if !user.EmailVerified {
+			respondWithError(w, http.StatusForbidden, "Email address has to be verified first")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// bootstrapAdmin creates or promotes the ADMIN_EMAIL account, an existing one only once its email is verified.
+func (cfg *apiConfig) bootstrapAdmin(db database.Store) error {
+	if cfg.adminEmail == "" {
+		return nil
+	}
+	user, err := db.GetUserByEmail(cfg.adminEmail)
+	if errors.Is(err, database.ErrEmailNotExist) {
+		if violations := cfg.passwordPolicy.Check(cfg.adminPassword, cfg.adminEmail); len(violations) > 0 {
+			return fmt.Errorf("ADMIN_PASSWORD doesn't meet the password policy: %s", violations[0].Message)
+		}
+		user, err = db.CreateUser(cfg.adminEmail, cfg.adminPassword)
+		if err != nil {
+			return err
+		}
+		log.Printf("Created admin account %s", user.Email)
+		if err := cfg.sendEmailVerification(db, user); err != nil {
+			return err
+		}
+		_, err = db.SetUserRole(user.ID, database.RoleAdmin)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if user.Role == database.RoleAdmin {
+		return nil
+	}
+	if !user.EmailVerified {
+		return fmt.Errorf("ADMIN_EMAIL %s belongs to an existing account whose email address isn't verified, refusing to make it an admin", user.Email)
+	}
+	log.Printf("Promoting existing account %s (ID %d) to admin", user.Email, user.ID)
+	_, err = db.SetUserRole(user.ID, database.RoleAdmin)
+	return err
+}
+
+// handlerSetUserRole gives the user in the path role, admins can't demote themselves.
+func handlerSetUserRole(db database.Store, role database.Role) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("userID"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+		if userID == principal(r).UserID && role != database.RoleAdmin {
+			respondWithError(w, http.StatusConflict, "Admins can't demote themselves")
+			return
+		}
+		user, err := db.SetUserRole(userID, role)
+		if err != nil {
+			if errors.Is(err, database.ErrUserNotExist) {
+				respondWithError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't change the role of the user in the database: %s", err))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, User{
+			ID:              user.ID,
+			Email:           user.Email,
+			ChirpyRedStatus: user.ChirpyRedStatus,
+			Role:            string(user.Role),
+			EmailVerified:   user.EmailVerified,
+			Suspended:       user.Suspended,
+			CreatedAt:       user.CreatedAt,
+			UpdatedAt:       user.UpdatedAt,
+		})
+	}
+}
+
+// handlerSetUserSuspended suspends or reinstates a user.
+func handlerSetUserSuspended(db database.Store, suspended bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(r.PathValue("userID"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+		if userID == principal(r).UserID && suspended {
+			respondWithError(w, http.StatusConflict, "Admins can't suspend themselves")
+			return
+		}
+		user, err := db.SetUserSuspended(userID, suspended)
+		if err != nil {
+			if errors.Is(err, database.ErrUserNotExist) {
+				respondWithError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't change the suspension of the user in the database: %s", err))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, User{
+			ID:              user.ID,
+			Email:           user.Email,
+			ChirpyRedStatus: user.ChirpyRedStatus,
+			Role:            string(user.Role),
+			EmailVerified:   user.EmailVerified,
+			Suspended:       user.Suspended,
+			CreatedAt:       user.CreatedAt,
+			UpdatedAt:       user.UpdatedAt,
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samgabel/web-server/internal/database"
+)
+
+const (
+	defaultChirpPageSize = 50
+	maxChirpPageSize     = 100
+	maxQueryAuthorIDs    = 50
+)
+
+// queryParamError is a problem with a single query parameter. It's reported back with the parameter's name so
+// clients know which one to fix.
+type queryParamError struct {
+	Param string
+	Err   error
+}
+
+func (e *queryParamError) Error() string {
+	return fmt.Sprintf("Can't process %s query: %s", e.Param, e.Err)
+}
+
+func (e *queryParamError) Unwrap() error {
+	return e.Err
+}
+
+func respondWithQueryError(w http.ResponseWriter, err error) {
+	paramErr := &queryParamError{}
+	if !errors.As(err, &paramErr) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	type errorResponse struct {
+		Error     string `json:"error"`
+		Parameter string `json:"parameter"`
+	}
+	respondWithJSON(w, http.StatusBadRequest, errorResponse{
+		Error:     paramErr.Error(),
+		Parameter: paramErr.Param,
+	})
+}
+
+// processChirpQuery parses the query language of the chirp listing:
+//
+//	author_id=1,2      chirps by any of these authors, the parameter can also be repeated
+//	since=<time>       chirps created at or after an RFC 3339 timestamp or a YYYY-MM-DD date
+//	until=<time>       chirps created before an RFC 3339 timestamp or a YYYY-MM-DD date
+//	contains=<text>    chirps whose body contains the text, ignoring case
+//	sort=<field>[:asc|desc]  order by id or created_at, 'asc' and 'desc' on their own order by id
+//	limit=<n>          page size
+//	cursor=<cursor>    the next_cursor of the previous page
+//
+// The returned error is a *queryParamError naming the offending parameter.
+func processChirpQuery(query url.Values) (database.ChirpQuery, error) {
+	return processQuery(database.ChirpQuery{}, query, []queryProcessor{
+		{"author_id", processQueryAuthorID},
+		{"since", processQuerySince},
+		{"until", processQueryUntil},
+		{"contains", processQueryContains},
+		{"sort", processQuerySort},
+		{"limit", processQueryLimit},
+		{"cursor", processQueryCursor},
+	})
+}
+
+// processSearchQuery is processChirpQuery for the search endpoint, which ignores sort as results are ordered by
+// relevance.
+func processSearchQuery(query url.Values) (database.ChirpQuery, error) {
+	return processQuery(database.ChirpQuery{SortBy: database.SortByRelevance}, query, []queryProcessor{
+		{"author_id", processQueryAuthorID},
+		{"since", processQuerySince},
+		{"until", processQueryUntil},
+		{"contains", processQueryContains},
+		{"limit", processQueryLimit},
+		{"cursor", processQueryCursor},
+	})
+}
+
+type queryProcessor struct {
+	param   string
+	process func(*database.ChirpQuery, []string) error
+}
+
+func processQuery(chirpQuery database.ChirpQuery, query url.Values, processors []queryProcessor) (database.ChirpQuery, error) {
+	for _, p := range processors {
+		if err := p.process(&chirpQuery, query[p.param]); err != nil {
+			return database.ChirpQuery{}, &queryParamError{Param: p.param, Err: err}
+		}
+	}
+	return chirpQuery, nil
+}
+
+// singleValue returns the only value given for a parameter, or "" if it wasn't given.
+func singleValue(values []string) (string, error) {
+	switch len(values) {
+	case 0:
+		return "", nil
+	case 1:
+		return values[0], nil
+	default:
+		return "", errors.New("Parameter given more than once")
+	}
+}
+
+func processQueryAuthorID(chirpQuery *database.ChirpQuery, values []string) error {
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			requestedAuthorID, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || requestedAuthorID < 1 {
+				return fmt.Errorf("Improper value %q given, need a comma separated list of positive ints", field)
+			}
+			chirpQuery.AuthorIDs = append(chirpQuery.AuthorIDs, requestedAuthorID)
+		}
+	}
+	if len(chirpQuery.AuthorIDs) > maxQueryAuthorIDs {
+		return fmt.Errorf("Too many authors given, need at most %d", maxQueryAuthorIDs)
+	}
+	return nil
+}
+
+func processQuerySince(chirpQuery *database.ChirpQuery, values []string) error {
+	since, err := parseQueryTime(values)
+	if err != nil {
+		return err
+	}
+	chirpQuery.Since = since
+	return nil
+}
+
+// processQueryUntil runs after processQuerySince so it can check the range isn't empty.
+func processQueryUntil(chirpQuery *database.ChirpQuery, values []string) error {
+	until, err := parseQueryTime(values)
+	if err != nil {
+		return err
+	}
+	if !until.IsZero() && !chirpQuery.Since.IsZero() && !until.After(chirpQuery.Since) {
+		return errors.New("Improper value given, need a time after since")
+	}
+	chirpQuery.Until = until
+	return nil
+}
+
+func parseQueryTime(values []string) (time.Time, error) {
+	value, err := singleValue(values)
+	if err != nil || value == "" {
+		return time.Time{}, err
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Improper value %q given, need an RFC 3339 timestamp or a YYYY-MM-DD date", value)
+}
+
+func processQueryContains(chirpQuery *database.ChirpQuery, values []string) error {
+	value, err := singleValue(values)
+	if err != nil {
+		return err
+	}
+	if len(value) > maxChirpLength {
+		return fmt.Errorf("Improper value given, need at most %d characters", maxChirpLength)
+	}
+	chirpQuery.Contains = value
+	return nil
+}
+
+func processQuerySort(chirpQuery *database.ChirpQuery, values []string) error {
+	querySortType, err := singleValue(values)
+	if err != nil {
+		return err
+	}
+	field, direction, _ := strings.Cut(querySortType, ":")
+	if field == "asc" || field == "desc" {
+		field, direction = "", field
+	}
+	switch database.ChirpSort(field) {
+	case "", database.SortByID:
+		chirpQuery.SortBy = database.SortByID
+	case database.SortByCreatedAt:
+		chirpQuery.SortBy = database.SortByCreatedAt
+	case "likes":
+		return errors.New("Chirps don't track likes, need 'id' or 'created_at'")
+	default:
+		return fmt.Errorf("Improper field %q given, need 'id' or 'created_at'", field)
+	}
+	if direction != "" && direction != "asc" && direction != "desc" {
+		return fmt.Errorf("Improper direction %q given, need 'asc' or 'desc'", direction)
+	}
+	chirpQuery.Descending = direction == "desc"
+	return nil
+}
+
+func processQueryLimit(chirpQuery *database.ChirpQuery, values []string) error {
+	queryLimit, err := singleValue(values)
+	if err != nil {
+		return err
+	}
+	if queryLimit == "" {
+		chirpQuery.Limit = defaultChirpPageSize
+		return nil
+	}
+	limit, err := strconv.Atoi(queryLimit)
+	if err != nil || limit < 1 || limit > maxChirpPageSize {
+		return fmt.Errorf("Improper value given, need int between 1 and %d", maxChirpPageSize)
+	}
+	chirpQuery.Limit = limit
+	return nil
+}
+
+// processQueryCursor runs after processQuerySort so it can reject a cursor from a listing in another order, or from a
+// search.
+func processQueryCursor(chirpQuery *database.ChirpQuery, values []string) error {
+	queryCursor, err := singleValue(values)
+	if err != nil || queryCursor == "" {
+		return err
+	}
+	cursor, err := decodeCursor(queryCursor)
+	if err != nil {
+		return errors.New("Improper value given, need a next_cursor from a previous response")
+	}
+	if cursor.SortBy != chirpQuery.SortBy {
+		return fmt.Errorf("Cursor wasn't issued for sort=%s", chirpQuery.SortBy)
+	}
+	chirpQuery.After = &cursor
+	return nil
+}
+
+// encodeCursor turns a page position into the opaque string handed out as next_cursor.
+func encodeCursor(cursor database.ChirpCursor) (string, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(encoded string) (database.ChirpCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return database.ChirpCursor{}, err
+	}
+	cursor := database.ChirpCursor{}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return database.ChirpCursor{}, err
+	}
+	return cursor, nil
+}
+
+// respondWithChirpPage writes a page of chirps, with its next_cursor and a Link header to the following page when
+// there is one.
+func respondWithChirpPage(w http.ResponseWriter, r *http.Request, page database.ChirpPage) {
+	response := ChirpPage{Chirps: []Chirp{}}
+	for _, chirp := range page.Chirps {
+		response.Chirps = append(response.Chirps, Chirp{
+			ID:        chirp.ID,
+			Body:      chirp.Body,
+			AuthorID:  chirp.AuthorID,
+			CreatedAt: chirp.CreatedAt,
+			UpdatedAt: chirp.UpdatedAt,
+		})
+	}
+	if page.Next != nil {
+		nextCursor, err := encodeCursor(*page.Next)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error encoding next cursor: %s", err))
+			return
+		}
+		response.NextCursor = nextCursor
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, nextPageURL(r, nextCursor)))
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// nextPageURL is the request URL with its cursor query parameter replaced, for the Link header.
+func nextPageURL(r *http.Request, nextCursor string) string {
+	next := *r.URL
+	query := next.Query()
+	query.Set("cursor", nextCursor)
+	next.RawQuery = query.Encode()
+	return next.RequestURI()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samgabel/web-server/internal/database"
+)
+
+func TestProcessChirpQuery(t *testing.T) {
+	day := func(s string) time.Time {
+		d, err := time.Parse(time.DateOnly, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	createdAt := day("2024-01-01")
+	createdAtCursor := cursor(t, database.ChirpCursor{ID: 7, SortBy: database.SortByCreatedAt, CreatedAt: &createdAt})
+	searchCursor := cursor(t, database.ChirpCursor{ID: 7, SortBy: database.SortByRelevance, Offset: 20})
+	unsortedCursor := cursor(t, database.ChirpCursor{ID: 7})
+	defaults := database.ChirpQuery{SortBy: database.SortByID, Limit: defaultChirpPageSize}
+
+	tests := []struct {
+		name  string
+		query string
+		want  database.ChirpQuery
+		// wantParam is the parameter the error has to name, empty if the query is valid.
+		wantParam string
+	}{
+		{name: "empty", query: "", want: defaults},
+		{
+			name:  "single author",
+			query: "author_id=3",
+			want:  database.ChirpQuery{AuthorIDs: []int{3}, SortBy: database.SortByID, Limit: defaultChirpPageSize},
+		},
+		{
+			name:  "comma separated authors",
+			query: "author_id=1,2,%203",
+			want:  database.ChirpQuery{AuthorIDs: []int{1, 2, 3}, SortBy: database.SortByID, Limit: defaultChirpPageSize},
+		},
+		{
+			name:  "repeated authors",
+			query: "author_id=1&author_id=4,5",
+			want:  database.ChirpQuery{AuthorIDs: []int{1, 4, 5}, SortBy: database.SortByID, Limit: defaultChirpPageSize},
+		},
+		{name: "author not a number", query: "author_id=1,x", wantParam: "author_id"},
+		{name: "author zero", query: "author_id=0", wantParam: "author_id"},
+		{name: "author empty in list", query: "author_id=1,,2", wantParam: "author_id"},
+		{name: "too many authors", query: "author_id=" + strings.Repeat("1,", maxQueryAuthorIDs) + "1", wantParam: "author_id"},
+		{
+			name:  "since and until dates",
+			query: "since=2024-01-01&until=2024-02-01",
+			want: database.ChirpQuery{
+				Since:  day("2024-01-01"),
+				Until:  day("2024-02-01"),
+				SortBy: database.SortByID,
+				Limit:  defaultChirpPageSize,
+			},
+		},
+		{
+			name:  "since timestamp",
+			query: "since=2024-01-01T12:30:00Z",
+			want: database.ChirpQuery{
+				Since:  time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC),
+				SortBy: database.SortByID,
+				Limit:  defaultChirpPageSize,
+			},
+		},
+		{
+			name:  "until only",
+			query: "until=2024-02-01",
+			want:  database.ChirpQuery{Until: day("2024-02-01"), SortBy: database.SortByID, Limit: defaultChirpPageSize},
+		},
+		{name: "since malformed", query: "since=yesterday", wantParam: "since"},
+		{name: "since repeated", query: "since=2024-01-01&since=2024-01-02", wantParam: "since"},
+		{name: "until malformed", query: "until=2024-13-01", wantParam: "until"},
+		{name: "until equal to since", query: "since=2024-01-01&until=2024-01-01", wantParam: "until"},
+		{name: "until before since", query: "since=2024-02-01&until=2024-01-01", wantParam: "until"},
+		{
+			name:  "contains",
+			query: "contains=Hello",
+			want:  database.ChirpQuery{Contains: "Hello", SortBy: database.SortByID, Limit: defaultChirpPageSize},
+		},
+		{name: "contains too long", query: "contains=" + strings.Repeat("a", maxChirpLength+1), wantParam: "contains"},
+		{
+			name:  "sort desc",
+			query: "sort=desc",
+			want:  database.ChirpQuery{SortBy: database.SortByID, Descending: true, Limit: defaultChirpPageSize},
+		},
+		{
+			name:  "sort created_at",
+			query: "sort=created_at",
+			want:  database.ChirpQuery{SortBy: database.SortByCreatedAt, Limit: defaultChirpPageSize},
+		},
+		{name: "sort likes", query: "sort=likes", wantParam: "sort"},
+		{name: "sort unknown field", query: "sort=author", wantParam: "sort"},
+		{name: "sort unknown direction", query: "sort=id:up", wantParam: "sort"},
+		{
+			name:  "limit",
+			query: "limit=10",
+			want:  database.ChirpQuery{SortBy: database.SortByID, Limit: 10},
+		},
+		{name: "limit zero", query: "limit=0", wantParam: "limit"},
+		{name: "limit too large", query: "limit=101", wantParam: "limit"},
+		{name: "limit not a number", query: "limit=ten", wantParam: "limit"},
+		{
+			name:  "cursor",
+			query: "sort=created_at&cursor=" + createdAtCursor,
+			want: database.ChirpQuery{
+				SortBy: database.SortByCreatedAt,
+				After:  &database.ChirpCursor{ID: 7, SortBy: database.SortByCreatedAt, CreatedAt: &createdAt},
+				Limit:  defaultChirpPageSize,
+			},
+		},
+		{name: "cursor from another sort", query: "sort=id&cursor=" + createdAtCursor, wantParam: "cursor"},
+		{name: "cursor from a search", query: "cursor=" + searchCursor, wantParam: "cursor"},
+		{name: "cursor without a sort", query: "cursor=" + unsortedCursor, wantParam: "cursor"},
+		{name: "cursor garbage", query: "cursor=not-a-cursor", wantParam: "cursor"},
+		{name: "first bad parameter is reported", query: "limit=0&author_id=x", wantParam: "author_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := processChirpQuery(query)
+			if tt.wantParam != "" {
+				paramErr, ok := err.(*queryParamError)
+				if !ok {
+					t.Fatalf("got error %v, want a *queryParamError for %s", err, tt.wantParam)
+				}
+				if paramErr.Param != tt.wantParam {
+					t.Errorf("error names parameter %q, want %q", paramErr.Param, tt.wantParam)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessSearchQuery(t *testing.T) {
+	searchCursor := cursor(t, database.ChirpCursor{ID: 7, SortBy: database.SortByRelevance, Offset: 20})
+	got, err := processSearchQuery(url.Values{"sort": {"created_at"}, "cursor": {searchCursor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := database.ChirpQuery{
+		SortBy: database.SortByRelevance,
+		After:  &database.ChirpCursor{ID: 7, SortBy: database.SortByRelevance, Offset: 20},
+		Limit:  defaultChirpPageSize,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	listingCursor := cursor(t, database.ChirpCursor{ID: 7, SortBy: database.SortByID})
+	_, err = processSearchQuery(url.Values{"cursor": {listingCursor}})
+	if paramErr, ok := err.(*queryParamError); !ok || paramErr.Param != "cursor" {
+		t.Errorf("got error %v for a listing cursor, want one for the cursor parameter", err)
+	}
+}
+
+func cursor(t *testing.T, c database.ChirpCursor) string {
+	t.Helper()
+	encoded, err := encodeCursor(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+// TestRespondWithQueryError checks the 400 response points clients at the parameter to fix.
+func TestRespondWithQueryError(t *testing.T) {
+	_, err := processChirpQuery(url.Values{"since": {"yesterday"}})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	w := httptest.NewRecorder()
+	respondWithQueryError(w, err)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	body := struct {
+		Error     string `json:"error"`
+		Parameter string `json:"parameter"`
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Parameter != "since" {
+		t.Errorf("got parameter %q, want %q", body.Parameter, "since")
+	}
+	if !strings.HasPrefix(body.Error, "Can't process since query: ") || !strings.Contains(body.Error, `"yesterday"`) {
+		t.Errorf("error %q doesn't name the parameter and the value", body.Error)
+	}
+}
@@ -1,37 +1,363 @@
 package main
 
-import "os"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/samgabel/web-server/internal/auth"
+	"github.com/samgabel/web-server/internal/database"
+	"github.com/samgabel/web-server/internal/mailer"
+)
 
 type apiConfig struct {
 	fileserverHits int
-	jwtSecret      string
+	jwtKeys        *auth.Keyset
 	polkaKey       string
+	// adminEmail and adminPassword are the bootstrap admin account, see bootstrapAdmin.
+	adminEmail    string
+	adminPassword string
+	db            database.Config
+	mailer        mailer.Mailer
+	// emailVerificationTTL is how long a verification email stays valid, requireVerifiedEmail whether an
+	// unverified address blocks posting chirps.
+	emailVerificationTTL time.Duration
+	requireVerifiedEmail bool
+	passwordResetTTL     time.Duration
+	passwordPolicy       auth.PasswordPolicy
+	// accountLockout and ipLockout throttle failed logins per account and per client address.
+	accountLockout database.LockoutPolicy
+	ipLockout      database.LockoutPolicy
+	// chirpRestoreWindow is how long an author can restore a deleted chirp, chirpRetention how long its tombstone
+	// is kept before the purge job removes it for good.
+	chirpRestoreWindow time.Duration
+	chirpRetention     time.Duration
+	chirpPurgeInterval time.Duration
 }
 
-func newAPIConfig() apiConfig {
+func newAPIConfig() (apiConfig, error) {
+	dbDriver := os.Getenv("DB_DRIVER")
+	if dbDriver == "" {
+		dbDriver = database.DriverJSON
+	}
+	dbPath := os.Getenv("DB_PATH")
+	if dbPath == "" && dbDriver == database.DriverSQLite {
+		dbPath = "database.db"
+	} else if dbPath == "" {
+		dbPath = "database.json"
+	}
+	snapshotInterval, err := durationFromEnv("DB_SNAPSHOT_INTERVAL", 30*time.Second)
+	if err != nil {
+		return apiConfig{}, err
+	}
+	chirpRestoreWindow, err := durationFromEnv("CHIRP_RESTORE_WINDOW", 24*time.Hour)
+	if err != nil {
+		return apiConfig{}, err
+	}
+	chirpRetention, err := durationFromEnv("CHIRP_RETENTION", 30*24*time.Hour)
+	if err != nil {
+		return apiConfig{}, err
+	}
+	if chirpRetention < chirpRestoreWindow {
+		return apiConfig{}, errors.New("CHIRP_RETENTION can't be shorter than CHIRP_RESTORE_WINDOW")
+	}
+	chirpPurgeInterval, err := durationFromEnv("CHIRP_PURGE_INTERVAL", time.Hour)
+	if err != nil {
+		return apiConfig{}, err
+	}
+	passwords, hashParams, err := loadPasswordHasher()
+	if err != nil {
+		return apiConfig{}, err
+	}
+	jwtKeys, err := loadJWTKeys()
+	if err != nil {
+		return apiConfig{}, err
+	}
+	emailVerificationTTL, err := durationFromEnv("EMAIL_VERIFICATION_TTL", 24*time.Hour)
+	if err != nil {
+		return apiConfig{}, err
+	}
+	requireVerifiedEmail, err := boolFromEnv("REQUIRE_EMAIL_VERIFICATION", false)
+	if err != nil {
+		return apiConfig{}, err
+	}
+	passwordResetTTL, err := durationFromEnv("PASSWORD_RESET_TTL", 15*time.Minute)
+	if err != nil {
+		return apiConfig{}, err
+	}
+	passwordPolicy, err := loadPasswordPolicy(hashParams.Algorithm)
+	if err != nil {
+		return apiConfig{}, err
+	}
+	accountLockout, ipLockout, err := loadLockoutPolicies()
+	if err != nil {
+		return apiConfig{}, err
+	}
+	mail, err := newLocalMailer()
+	if err != nil {
+		return apiConfig{}, err
+	}
+	adminEmail, adminPassword := os.Getenv("ADMIN_EMAIL"), os.Getenv("ADMIN_PASSWORD")
+	if adminEmail != "" && adminPassword == "" {
+		return apiConfig{}, errors.New("ADMIN_PASSWORD is required when ADMIN_EMAIL is set")
+	}
 	return apiConfig{
 		fileserverHits: 0,
-		jwtSecret:      os.Getenv("JWT_SECRET"),
+		jwtKeys:        jwtKeys,
 		polkaKey:       os.Getenv("POLKA_KEY"),
+		adminEmail:     adminEmail,
+		adminPassword:  adminPassword,
+		db: database.Config{
+			Driver:           dbDriver,
+			Path:             dbPath,
+			SnapshotInterval: snapshotInterval,
+			Passwords:        passwords,
+		},
+		mailer:               mail,
+		emailVerificationTTL: emailVerificationTTL,
+		requireVerifiedEmail: requireVerifiedEmail,
+		passwordResetTTL:     passwordResetTTL,
+		passwordPolicy:       passwordPolicy,
+		accountLockout:       accountLockout,
+		ipLockout:            ipLockout,
+		chirpRestoreWindow:   chirpRestoreWindow,
+		chirpRetention:       chirpRetention,
+		chirpPurgeInterval:   chirpPurgeInterval,
+	}, nil
+}
+
+// durationFromEnv parses the environment variable key with time.ParseDuration, falling back to def when unset.
+func durationFromEnv(key string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: %w", key, err)
 	}
+	return d, nil
+}
+
+// boolFromEnv parses the environment variable key with strconv.ParseBool, falling back to def when unset.
+func boolFromEnv(key string, def bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s: %w", key, err)
+	}
+	return b, nil
+}
+
+// intFromEnv parses the environment variable key with strconv.Atoi, falling back to def when unset.
+func intFromEnv(key string, def int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: %w", key, err)
+	}
+	return i, nil
+}
+
+// loadPasswordHasher reads the algorithm and cost new password hashes are computed with.
+func loadPasswordHasher() (*auth.PasswordHasher, auth.PasswordHashParams, error) {
+	params := auth.DefaultPasswordHashParams
+	if algorithm := os.Getenv("PASSWORD_HASH_ALGORITHM"); algorithm != "" {
+		params.Algorithm = auth.PasswordAlgorithm(algorithm)
+	}
+	var err error
+	params.BcryptCost, err = intFromEnv("PASSWORD_BCRYPT_COST", params.BcryptCost)
+	if err != nil {
+		return nil, params, err
+	}
+	memory, err := intFromEnv("PASSWORD_ARGON2_MEMORY_KIB", int(params.Argon2.Memory))
+	if err != nil {
+		return nil, params, err
+	}
+	iterations, err := intFromEnv("PASSWORD_ARGON2_ITERATIONS", int(params.Argon2.Iterations))
+	if err != nil {
+		return nil, params, err
+	}
+	parallelism, err := intFromEnv("PASSWORD_ARGON2_PARALLELISM", int(params.Argon2.Parallelism))
+	if err != nil {
+		return nil, params, err
+	}
+	if memory < 0 || memory > math.MaxUint32 || iterations < 0 || iterations > math.MaxUint32 ||
+		parallelism < 0 || parallelism > math.MaxUint8 {
+		return nil, params, errors.New(
+			"PASSWORD_ARGON2_MEMORY_KIB, PASSWORD_ARGON2_ITERATIONS or PASSWORD_ARGON2_PARALLELISM is out of range",
+		)
+	}
+	params.Argon2 = auth.Argon2Params{Memory: uint32(memory), Iterations: uint32(iterations), Parallelism: uint8(parallelism)}
+	hasher, err := auth.NewPasswordHasher(params)
+	if err != nil {
+		return nil, params, fmt.Errorf("Invalid password hash configuration: %w", err)
+	}
+	return hasher, params, nil
+}
+
+// loadPasswordPolicy reads the rules new passwords have to follow, capping the length at 72 bytes for bcrypt.
+func loadPasswordPolicy(algorithm auth.PasswordAlgorithm) (auth.PasswordPolicy, error) {
+	minLength, err := intFromEnv("PASSWORD_MIN_LENGTH", 8)
+	if err != nil {
+		return auth.PasswordPolicy{}, err
+	}
+	maxLength, err := intFromEnv("PASSWORD_MAX_LENGTH", 72)
+	if err != nil {
+		return auth.PasswordPolicy{}, err
+	}
+	if minLength < 1 || maxLength < minLength {
+		return auth.PasswordPolicy{}, errors.New("PASSWORD_MIN_LENGTH must be positive, and PASSWORD_MAX_LENGTH at least as long")
+	}
+	if algorithm == auth.AlgorithmBcrypt && maxLength > 72 {
+		return auth.PasswordPolicy{}, errors.New("PASSWORD_MAX_LENGTH can't be more than 72 with bcrypt")
+	}
+	classes, err := auth.ParseCharacterClasses(os.Getenv("PASSWORD_REQUIRED_CLASSES"))
+	if err != nil {
+		return auth.PasswordPolicy{}, fmt.Errorf("Invalid PASSWORD_REQUIRED_CLASSES: %w", err)
+	}
+	policy := auth.PasswordPolicy{MinLength: minLength, MaxLength: maxLength, RequiredClasses: classes}
+	if path := os.Getenv("BREACHED_PASSWORDS_FILE"); path != "" {
+		policy.Breached, err = auth.LoadBreachedPasswords(path)
+		if err != nil {
+			return auth.PasswordPolicy{}, fmt.Errorf("Invalid BREACHED_PASSWORDS_FILE: %w", err)
+		}
+		log.Printf("Loaded %d breached passwords", policy.Breached.Len())
+	}
+	return policy, nil
+}
+
+// loadLockoutPolicies reads how failed logins are throttled per account and per client address.
+func loadLockoutPolicies() (database.LockoutPolicy, database.LockoutPolicy, error) {
+	maxFailures, err := intFromEnv("LOGIN_MAX_FAILURES", 5)
+	if err != nil {
+		return database.LockoutPolicy{}, database.LockoutPolicy{}, err
+	}
+	ipMaxFailures, err := intFromEnv("LOGIN_IP_MAX_FAILURES", 20)
+	if err != nil {
+		return database.LockoutPolicy{}, database.LockoutPolicy{}, err
+	}
+	lockout, err := durationFromEnv("LOGIN_LOCKOUT", time.Minute)
+	if err != nil {
+		return database.LockoutPolicy{}, database.LockoutPolicy{}, err
+	}
+	maxLockout, err := durationFromEnv("LOGIN_LOCKOUT_MAX", time.Hour)
+	if err != nil {
+		return database.LockoutPolicy{}, database.LockoutPolicy{}, err
+	}
+	if maxFailures < 1 || ipMaxFailures < 1 || lockout <= 0 || maxLockout < lockout {
+		return database.LockoutPolicy{}, database.LockoutPolicy{}, errors.New(
+			"LOGIN_MAX_FAILURES and LOGIN_IP_MAX_FAILURES must be positive, and LOGIN_LOCKOUT_MAX at least LOGIN_LOCKOUT",
+		)
+	}
+	return database.LockoutPolicy{MaxFailures: maxFailures, Lockout: lockout, MaxLockout: maxLockout},
+		database.LockoutPolicy{MaxFailures: ipMaxFailures, Lockout: lockout, MaxLockout: maxLockout},
+		nil
+}
+
+// newLocalMailer writes outgoing emails to the MAIL_FILE it appends to, or to stderr when that's unset.
+func newLocalMailer() (mailer.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Chirpy <no-reply@chirpy.localhost>"
+	}
+	var w io.Writer = os.Stderr
+	if path := os.Getenv("MAIL_FILE"); path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid MAIL_FILE: %w", err)
+		}
+		w = f
+	}
+	return mailer.NewLocal(w, from), nil
+}
+
+// loadJWTKeys loads the keys in JWT_KEYS_DIR when it's set, and only JWT_SECRET otherwise.
+func loadJWTKeys() (*auth.Keyset, error) {
+	keysDir := os.Getenv("JWT_KEYS_DIR")
+	if keysDir == "" {
+		return auth.NewHMACKeyset(os.Getenv("JWT_SECRET"))
+	}
+	return auth.LoadKeyset(keysDir, os.Getenv("JWT_KEY_ID"), os.Getenv("JWT_SECRET"))
 }
 
 type Chirp struct {
-	ID       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorID int    `json:"author_id"`
+	ID        int       `json:"id"`
+	Body      string    `json:"body"`
+	AuthorID  int       `json:"author_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ChirpPage is one page of the chirp listing, NextCursor is passed back as the cursor query parameter to fetch
+// the following page and is omitted on the last one.
+type ChirpPage struct {
+	Chirps     []Chirp `json:"chirps"`
+	NextCursor string  `json:"next_cursor,omitempty"`
 }
 
 type User struct {
-	ID              int    `json:"id"`
-	Email           string `json:"email"`
-	ChirpyRedStatus bool   `json:"is_chirpy_red"`
+	ID              int       `json:"id"`
+	Email           string    `json:"email"`
+	ChirpyRedStatus bool      `json:"is_chirpy_red"`
+	Role            string    `json:"role"`
+	EmailVerified   bool      `json:"email_verified"`
+	Suspended       bool      `json:"suspended"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	// PendingEmail is the address an email change is waiting to be confirmed from.
+	PendingEmail string `json:"pending_email,omitempty"`
+}
+
+// Session is one of the devices a user is signed in on, the refresh token itself is never shown.
+type Session struct {
+	ID          int       `json:"id"`
+	DeviceLabel string    `json:"device_label"`
+	UserAgent   string    `json:"user_agent"`
+	IP          string    `json:"ip"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
 }
 
 type AuthenticatedUser struct {
-	ID              int    `json:"id"`
-	Email           string `json:"email"`
-	Token           string `json:"token"`
-	RefreshToken    string `json:"refresh_token"`
-	ChirpyRedStatus bool   `json:"is_chirpy_red"`
+	ID              int       `json:"id"`
+	Email           string    `json:"email"`
+	Token           string    `json:"token"`
+	RefreshToken    string    `json:"refresh_token"`
+	ChirpyRedStatus bool      `json:"is_chirpy_red"`
+	Role            string    `json:"role"`
+	EmailVerified   bool      `json:"email_verified"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// MFAChallenge is the response to a correct password when the user still has to send a TOTP or recovery code along
+// with MFAToken to /api/login/mfa.
+type MFAChallenge struct {
+	MFARequired bool      `json:"mfa_required"`
+	MFAToken    string    `json:"mfa_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// TOTPEnrollment is shown once when enrolling in two-factor authentication, the secret is never shown again.
+type TOTPEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// RecoveryCodes are shown once when they're generated, only their digests are stored.
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
 }
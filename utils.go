@@ -4,12 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"net"
 	"net/http"
-	"slices"
-	"strconv"
 	"strings"
-
-	"github.com/samgabel/web-server/internal/database"
 )
 
 func respondWithJSON(w http.ResponseWriter, status int, payload interface{}) {
@@ -36,8 +33,18 @@ func respondWithError(w http.ResponseWriter, status int, msg string) {
 	})
 }
 
+// clientIP returns the address of the peer a request came from, without its port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+const maxChirpLength = 140
+
 func validateChirp(body string) (string, error) {
-	const maxChirpLength = 140
 	if len(body) > maxChirpLength {
 		return "", errors.New("Chirp is too long")
 	}
@@ -60,53 +67,3 @@ func getCleanedBody(badWords map[string]struct{}, body string) string {
 	}
 	return strings.Join(words, " ")
 }
-
-func processQueryAuthorID(chirps []database.Chirp, query string) ([]Chirp, error) {
-	if query == "" {
-		selection := []Chirp{}
-		for _, chirp := range chirps {
-			selection = append(selection, Chirp{
-				ID:       chirp.ID,
-				Body:     chirp.Body,
-				AuthorID: chirp.AuthorID,
-			})
-		}
-		return selection, nil
-	}
-	requestedAuthorID, err := strconv.Atoi(query)
-	if err != nil {
-		return []Chirp{}, errors.New("Improper value given, need int")
-	}
-	querySelection := []Chirp{}
-	for _, chirp := range chirps {
-		if chirp.AuthorID == requestedAuthorID {
-			querySelection = append(querySelection, Chirp{
-				ID:       chirp.ID,
-				Body:     chirp.Body,
-				AuthorID: chirp.AuthorID,
-			})
-		}
-	}
-	if len(querySelection) == 0 {
-		return []Chirp{}, errors.New("No chirps found associated with the given value")
-	}
-	return querySelection, nil
-}
-
-func processQuerySort(querySelection []Chirp, querySortType string) ([]Chirp, error) {
-	if querySortType != "asc" && querySortType != "desc" && querySortType != "" {
-		return []Chirp{}, errors.New("Improper value given, need 'asc' or 'desc'")
-	}
-	if querySortType == "desc" {
-		slices.SortFunc(querySelection, func(a, b Chirp) int {
-			if a.ID < b.ID {
-				return 1
-			}
-			if a.ID > b.ID {
-				return -1
-			}
-			return 0
-		})
-	}
-	return querySelection, nil
-}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+
+	"github.com/samgabel/web-server/internal/auth"
+	"github.com/samgabel/web-server/internal/database"
+	"github.com/samgabel/web-server/internal/mailer"
+)
+
+// validateEmail only accepts a bare address such as "someone@example.com", without a display name.
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.New("Email is not a valid address")
+	}
+	return nil
+}
+
+// sendEmailVerification mails user a single-use token that verifies their current address.
+func (cfg *apiConfig) sendEmailVerification(db database.Store, user database.User) error {
+	token, claims, err := auth.NewEmailVerificationToken(user.ID, user.Email, cfg.jwtKeys, cfg.emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+	err = db.RecordEmailVerification(database.EmailVerification{
+		ID:        claims.ID,
+		UserID:    user.ID,
+		Email:     user.Email,
+		ExpiresAt: claims.ExpiresAt.Time,
+	})
+	if err != nil {
+		return err
+	}
+	return cfg.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your Chirpy email address",
+		Body: fmt.Sprintf(
+			"Send this token to POST /api/users/verify within %s to verify your email address:\r\n\r\n%s",
+			cfg.emailVerificationTTL, token,
+		),
+	})
+}
+
+// sendEmailChange mails a confirmation token to the new address and a notice to the current one.
+func (cfg *apiConfig) sendEmailChange(db database.Store, user database.User, newEmail string) error {
+	token, claims, err := auth.NewEmailChangeToken(user.ID, newEmail, cfg.jwtKeys, cfg.emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+	err = db.RecordEmailChange(database.EmailChange{
+		ID:        claims.ID,
+		UserID:    user.ID,
+		OldEmail:  user.Email,
+		NewEmail:  newEmail,
+		ExpiresAt: claims.ExpiresAt.Time,
+	})
+	if err != nil {
+		return err
+	}
+	err = cfg.mailer.Send(mailer.Message{
+		To:      newEmail,
+		Subject: "Confirm your new Chirpy email address",
+		Body: fmt.Sprintf(
+			"Send this token to POST /api/users/email/confirm within %s to change your email address to this one:\r\n\r\n%s",
+			cfg.emailVerificationTTL, token,
+		),
+	})
+	if err != nil {
+		return err
+	}
+	err = cfg.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your Chirpy email address is being changed",
+		Body: fmt.Sprintf(
+			"Someone signed in to your account asked to change its email address to %s. It only changes once the "+
+				"new address is confirmed.\r\n\r\nIf this wasn't you, reset your password.",
+			newEmail,
+		),
+	})
+	if err != nil {
+		log.Printf("Email change notice to user %d failed: %s", user.ID, err)
+	}
+	return nil
+}
+
+// handlerConfirmEmailChange moves a user to the address a token from sendEmailChange was sent to.
+func (cfg *apiConfig) handlerConfirmEmailChange(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type parameters struct {
+			Token string `json:"token"`
+		}
+		params := parameters{}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+			return
+		}
+		claims, err := auth.VerifyEmailChangeToken(params.Token, cfg.jwtKeys)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid email change token: %s", err))
+			return
+		}
+		user, err := db.ConfirmEmailChange(claims.ID)
+		switch {
+		case errors.Is(err, database.ErrEmailChangeInvalid):
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		case errors.Is(err, database.ErrEmailRegistered):
+			respondWithError(w, http.StatusConflict, err.Error())
+			return
+		case err != nil:
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't change the email in the database: %s", err))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, User{
+			ID:              user.ID,
+			Email:           user.Email,
+			ChirpyRedStatus: user.ChirpyRedStatus,
+			Role:            string(user.Role),
+			EmailVerified:   user.EmailVerified,
+			CreatedAt:       user.CreatedAt,
+			UpdatedAt:       user.UpdatedAt,
+		})
+	}
+}
+
+func (cfg *apiConfig) handlerVerifyEmail(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type parameters struct {
+			Token string `json:"token"`
+		}
+		params := parameters{}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+			return
+		}
+		claims, err := auth.VerifyEmailVerificationToken(params.Token, cfg.jwtKeys)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid verification token: %s", err))
+			return
+		}
+		user, err := db.VerifyEmail(claims.ID)
+		if err != nil {
+			if errors.Is(err, database.ErrVerificationInvalid) {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't verify the email in the database: %s", err))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, User{
+			ID:              user.ID,
+			Email:           user.Email,
+			ChirpyRedStatus: user.ChirpyRedStatus,
+			Role:            string(user.Role),
+			EmailVerified:   user.EmailVerified,
+			CreatedAt:       user.CreatedAt,
+			UpdatedAt:       user.UpdatedAt,
+		})
+	}
+}
+
+// handlerResendEmailVerification mails the signed in user a new verification token, for when the previous one got
+// lost or expired.
+func (cfg *apiConfig) handlerResendEmailVerification(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := db.GetUser(principal(r).UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't look up the user in the database: %s", err))
+			return
+		}
+		if user.EmailVerified {
+			respondWithError(w, http.StatusConflict, "Email address is already verified")
+			return
+		}
+		if err := cfg.sendEmailVerification(db, user); err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't send the verification email: %s", err))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}